@@ -21,6 +21,7 @@ import (
 	"flag"
 	"fmt"
 	"strings"
+	"time"
 
 	ntnxIam "github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/admin"
 	"github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/driver"
@@ -48,6 +49,37 @@ var (
 	PCCACert      = ""
 	S3Insecure    = false
 	PCInsecure    = false
+
+	LifecycleConfigDir = "/etc/cosi/lifecycle"
+	ObjectStoreUUID    = ""
+	ClusterID          = ""
+
+	UsernameTemplate    = driver.DefaultUsernameTemplate
+	DisplayNameTemplate = driver.DefaultDisplayNameTemplate
+
+	Region          = driver.DefaultRegion
+	PublishCABundle = false
+
+	Quarantine            = false
+	QuarantineGracePeriod = driver.DefaultQuarantineGracePeriod
+
+	ObjectStoresConfig = ""
+
+	ObjectStoreName         = ""
+	ResolveS3CACert         = false
+	EndpointScheme          = ""
+	EndpointPort            = 0
+	EndpointRefreshInterval = driver.DefaultEndpointRefreshInterval
+
+	BootstrapCredentials = ""
+	BootstrapUsername    = driver.DefaultServiceUsername
+	KeyRotationInterval  = driver.DefaultKeyRotationInterval
+	KeyOverlap           = driver.DefaultKeyOverlap
+
+	GrantKeyRotationInterval time.Duration
+	GrantKeyOverlap          = driver.DefaultGrantKeyOverlap
+	GrantKeyDeleteRetired    = false
+	RotationStatusAddress    = driver.DefaultRotationStatusAddress
 )
 
 var cmd = &cobra.Command{
@@ -135,6 +167,110 @@ func init() {
 		PCInsecure,
 		"Controls whether certificate chain will be validated for Prism Central endpoint (true/false)")
 
+	persistentFlags.StringVar(&LifecycleConfigDir,
+		"lifecycle_config_dir",
+		LifecycleConfigDir,
+		"Directory holding the lifecycle documents referenced by the lifecycleConfigRef BucketClass parameter")
+
+	persistentFlags.StringVar(&ObjectStoreUUID,
+		"objectstore_uuid",
+		ObjectStoreUUID,
+		"UUID of the Nutanix Object Store in Prism Central, required for bucket quotas")
+
+	persistentFlags.StringVar(&ClusterID,
+		"cluster_id",
+		ClusterID,
+		"Identifier of the kubernetes cluster recorded in the tags of provisioned buckets")
+
+	persistentFlags.StringVar(&UsernameTemplate,
+		"username_template",
+		UsernameTemplate,
+		"Go template of the IAM username created for a BucketAccess, it must render an email address containing {{ .Name }}")
+
+	persistentFlags.StringVar(&DisplayNameTemplate,
+		"display_name_template",
+		DisplayNameTemplate,
+		"Go template of the display name of the IAM user created for a BucketAccess")
+
+	persistentFlags.StringVar(&Region,
+		"region",
+		Region,
+		"Region returned in the credentials of bucket accesses, unless the BucketClass sets its own")
+
+	persistentFlags.BoolVar(&PublishCABundle,
+		"publish_ca_bundle",
+		PublishCABundle,
+		"Writes the CA bundle of the object store to a ConfigMap next to the Secret of each bucket access (true/false)")
+
+	persistentFlags.BoolVar(&Quarantine,
+		"quarantine",
+		Quarantine,
+		"Enables the quarantineOnDelete BucketClass parameter and the reaper deleting quarantined buckets (true/false)")
+	persistentFlags.DurationVar(&QuarantineGracePeriod,
+		"quarantine_grace_period",
+		QuarantineGracePeriod,
+		"How long buckets deleted with quarantineOnDelete are kept before they are purged")
+
+	persistentFlags.StringVar(&ObjectStoresConfig,
+		"object_stores_config",
+		ObjectStoresConfig,
+		"Path of the config file listing further object stores, selected by the objectStore BucketClass parameter")
+
+	persistentFlags.StringVar(&ObjectStoreName,
+		"objectstore_name",
+		ObjectStoreName,
+		"Name of the Nutanix Object Store in Prism Central, its endpoint is looked up instead of setting --endpoint")
+	persistentFlags.BoolVar(&ResolveS3CACert,
+		"resolve_s3_ca_cert",
+		ResolveS3CACert,
+		"Fetches the CA certificate of the object store found by --objectstore_name from Prism Central (true/false)")
+	persistentFlags.StringVar(&EndpointScheme,
+		"objectstore_endpoint_scheme",
+		EndpointScheme,
+		"Scheme of the endpoint of the object store found by --objectstore_name, http or https (default https)")
+	persistentFlags.IntVar(&EndpointPort,
+		"objectstore_endpoint_port",
+		EndpointPort,
+		"Port of the endpoint of the object store found by --objectstore_name, 0 for the port of the scheme")
+	persistentFlags.DurationVar(&EndpointRefreshInterval,
+		"endpoint_refresh_interval",
+		EndpointRefreshInterval,
+		"How often the endpoint of an object store given by name is looked up again")
+
+	persistentFlags.StringVar(&BootstrapCredentials,
+		"bootstrap_credentials",
+		BootstrapCredentials,
+		"Enables the bootstrap mode: the driver creates its own IAM user and stores its keys in file:<path> or secret:[<namespace>/]<name>")
+	persistentFlags.StringVar(&BootstrapUsername,
+		"bootstrap_username",
+		BootstrapUsername,
+		"IAM username of the service user created by the bootstrap mode, it must be an email address")
+	persistentFlags.DurationVar(&KeyRotationInterval,
+		"key_rotation_interval",
+		KeyRotationInterval,
+		"How often the bootstrap mode replaces the keys of the service user, 0 disables the rotation")
+	persistentFlags.DurationVar(&KeyOverlap,
+		"key_overlap",
+		KeyOverlap,
+		"How long the previous key of the service user stays valid after a rotation")
+
+	persistentFlags.DurationVar(&GrantKeyRotationInterval,
+		"grant_key_rotation_interval",
+		GrantKeyRotationInterval,
+		"Age at which the access key of a bucket access of a class setting keyRotation is replaced, 0 disables the rotation")
+	persistentFlags.DurationVar(&GrantKeyOverlap,
+		"grant_key_overlap",
+		GrantKeyOverlap,
+		"How long the previous access key of a bucket access stays valid after a rotation at least")
+	persistentFlags.BoolVar(&GrantKeyDeleteRetired,
+		"grant_key_delete_retired",
+		GrantKeyDeleteRetired,
+		"Deletes the previous access key of a bucket access once the overlap is over, instead of waiting for its consumer to acknowledge the new key (true/false)")
+	persistentFlags.StringVar(&RotationStatusAddress,
+		"rotation_status_address",
+		RotationStatusAddress,
+		"Loopback address serving the access key rotation status, empty to disable it")
+
 	viper.BindPFlags(cmd.PersistentFlags())
 	cmd.PersistentFlags().VisitAll(func(f *pflag.Flag) {
 		if viper.IsSet(f.Name) && viper.GetString(f.Name) != "" {
@@ -144,11 +280,50 @@ func init() {
 }
 
 func run(ctx context.Context) error {
-	PCEndpoint, PCUsername, PCPassword, err := ntnxIam.GetCredsFromPCSecret(PCSecret)
-	if err != nil {
-		errMsg := fmt.Errorf("failed to extract PC credential information from secret: %w", err)
-		klog.Error(errMsg)
-		return err
+	var objectStores *driver.ObjectStoresConfig
+	if ObjectStoresConfig != "" {
+		var err error
+		if objectStores, err = driver.LoadObjectStoresConfig(ObjectStoresConfig); err != nil {
+			klog.Error(err)
+			return err
+		}
+	}
+
+	// the object store of the flags is optional when the config file lists object stores
+	var PCEndpoint, PCUsername, PCPassword string
+	if Endpoint != "" || ObjectStoreName != "" || objectStores == nil {
+		var err error
+		PCEndpoint, PCUsername, PCPassword, err = ntnxIam.GetCredsFromPCSecret(PCSecret)
+		if err != nil {
+			errMsg := fmt.Errorf("failed to extract PC credential information from secret: %w", err)
+			klog.Error(errMsg)
+			return err
+		}
+	}
+
+	var bootstrap *driver.BootstrapOptions
+	if BootstrapCredentials != "" {
+		store, err := driver.NewCredentialStore(BootstrapCredentials)
+		if err != nil {
+			klog.Error(err)
+			return err
+		}
+		bootstrap = &driver.BootstrapOptions{
+			Store:            store,
+			Username:         BootstrapUsername,
+			RotationInterval: KeyRotationInterval,
+			KeyOverlap:       KeyOverlap,
+		}
+	}
+
+	var keyRotation *driver.KeyRotationOptions
+	if GrantKeyRotationInterval > 0 {
+		keyRotation = &driver.KeyRotationOptions{
+			Interval:          GrantKeyRotationInterval,
+			Overlap:           GrantKeyOverlap,
+			DeleteRetiredKeys: GrantKeyDeleteRetired,
+			StatusAddress:     RotationStatusAddress,
+		}
 	}
 
 	identityServer, bucketProvisioner, err := driver.NewDriver(ctx,
@@ -163,7 +338,28 @@ func run(ctx context.Context) error {
 		S3CACert,
 		PCCACert,
 		S3Insecure,
-		PCInsecure)
+		PCInsecure,
+		driver.Options{
+			LifecycleConfigDir: LifecycleConfigDir,
+			ObjectStoreUUID:    ObjectStoreUUID,
+			ClusterID:          ClusterID,
+
+			Quarantine:            Quarantine,
+			QuarantineGracePeriod: QuarantineGracePeriod,
+			UsernameTemplate:      UsernameTemplate,
+			DisplayNameTemplate:   DisplayNameTemplate,
+			Region:                Region,
+			PublishCABundle:       PublishCABundle,
+			ObjectStores:          objectStores,
+
+			ObjectStoreName:         ObjectStoreName,
+			ResolveS3CACert:         ResolveS3CACert,
+			EndpointScheme:          EndpointScheme,
+			EndpointPort:            EndpointPort,
+			EndpointRefreshInterval: EndpointRefreshInterval,
+			Bootstrap:               bootstrap,
+			KeyRotation:             keyRotation,
+		})
 	if err != nil {
 		return err
 	}
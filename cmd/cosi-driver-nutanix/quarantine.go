@@ -0,0 +1,150 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	ntnxIam "github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/admin"
+	"github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/driver"
+	"github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/util/s3client"
+	"github.com/spf13/cobra"
+)
+
+// quarantineObjectStore names the object store of the object stores config file to inspect
+var quarantineObjectStore = ""
+
+var quarantineCmd = &cobra.Command{
+	Use:   "quarantine",
+	Short: "Inspect and restore buckets quarantined by quarantineOnDelete",
+}
+
+var quarantineListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the quarantined buckets and when they will be deleted",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		q, err := newQuarantine(cmd.Context())
+		if err != nil {
+			return err
+		}
+		buckets, err := q.List()
+		if err != nil {
+			return err
+		}
+		for _, b := range buckets {
+			fmt.Fprintf(cmd.OutOrStdout(), "%s\tdeleted %s\treaped after %s\n",
+				b.Name, b.DeletedAt.Format(time.RFC3339), b.DeletedAt.Add(QuarantineGracePeriod).Format(time.RFC3339))
+		}
+		return nil
+	},
+}
+
+var quarantineRestoreCmd = &cobra.Command{
+	Use:   "restore <bucket>",
+	Short: "Take a bucket out of quarantine before its grace period ends",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		q, err := newQuarantine(cmd.Context())
+		if err != nil {
+			return err
+		}
+		if err := q.Restore(args[0]); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "bucket %s restored\n", args[0])
+		return nil
+	},
+}
+
+func init() {
+	quarantineCmd.PersistentFlags().StringVar(&quarantineObjectStore,
+		"object_store",
+		quarantineObjectStore,
+		"Object store of the object stores config file holding the buckets, the one of the driver flags when empty")
+	quarantineCmd.AddCommand(quarantineListCmd, quarantineRestoreCmd)
+	cmd.AddCommand(quarantineCmd)
+}
+
+// newQuarantine connects to the object store selected by --object_store,
+// or to the one configured through the driver flags
+func newQuarantine(ctx context.Context) (*driver.Quarantine, error) {
+	accessKey, secretKey, endpoint, caCert, insecure := AccessKey, SecretKey, Endpoint, S3CACert, S3Insecure
+	objectStoreName, pcSecret, pcCACert, pcInsecure := ObjectStoreName, PCSecret, PCCACert, PCInsecure
+	endpointScheme, endpointPort, resolveCACert := EndpointScheme, EndpointPort, ResolveS3CACert
+	if quarantineObjectStore != "" {
+		if ObjectStoresConfig == "" {
+			return nil, fmt.Errorf("--object_store requires --object_stores_config")
+		}
+		config, err := driver.LoadObjectStoresConfig(ObjectStoresConfig)
+		if err != nil {
+			return nil, err
+		}
+		store, err := config.Get(quarantineObjectStore)
+		if err != nil {
+			return nil, err
+		}
+		accessKey, secretKey, endpoint, caCert, insecure = store.AccessKey, store.SecretKey, store.Endpoint, store.S3CACert, store.S3Insecure
+		objectStoreName, pcSecret, pcCACert, pcInsecure = store.ObjectStoreName, store.PCSecret, store.PCCACert, store.PCInsecure
+		endpointScheme, endpointPort, resolveCACert = store.EndpointScheme, store.EndpointPort, store.ResolveS3CACert
+	} else if BootstrapCredentials != "" {
+		// the driver runs with the keys of its service user
+		store, err := driver.NewCredentialStore(BootstrapCredentials)
+		if err != nil {
+			return nil, err
+		}
+		creds, found, err := store.Load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("no service user credentials stored in %s", BootstrapCredentials)
+		}
+		accessKey, secretKey = creds.AccessKey, creds.SecretKey
+	}
+
+	// the endpoint of an object store given by name is looked up in Prism Central,
+	// along with its CA certificate as the driver does
+	if endpoint == "" && objectStoreName != "" {
+		pcEndpoint, pcUsername, pcPassword, err := ntnxIam.GetCredsFromPCSecret(pcSecret)
+		if err != nil {
+			return nil, err
+		}
+		pc, err := ntnxIam.NewPCClient(pcEndpoint, pcUsername, pcPassword, pcCACert, pcInsecure, nil)
+		if err != nil {
+			return nil, err
+		}
+		objectStore, resolved, err := driver.ResolveObjectStore(ctx, pc, objectStoreName, endpointScheme, endpointPort)
+		if err != nil {
+			return nil, err
+		}
+		endpoint = resolved
+		if resolveCACert && caCert == "" && !insecure {
+			if caCert, err = pc.GetObjectStoreCACert(ctx, objectStore.UUID); err != nil {
+				return nil, fmt.Errorf("failed to fetch CA certificate of object store %q: %w", objectStoreName, err)
+			}
+		}
+	}
+
+	s3Client, err := s3client.NewS3Agent(accessKey, secretKey, endpoint, caCert, insecure, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+	return driver.NewQuarantine(s3Client, provisionerName, QuarantineGracePeriod), nil
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/driver"
+	"github.com/spf13/cobra"
+)
+
+var rotationCmd = &cobra.Command{
+	Use:   "rotation",
+	Short: "Inspect and trigger the rotation of bucket access keys by the running driver",
+}
+
+var rotationStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "List the bucket accesses with their current key and next rotation",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		status := driver.RotationStatus{}
+		if err := rotationRequest(cmd.Context(), http.MethodGet, nil, &status); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "last run %s\n", status.LastRun.Format(time.RFC3339))
+		for _, g := range status.Grants {
+			printGrantKeyStatus(cmd.OutOrStdout(), g)
+		}
+		return nil
+	},
+}
+
+var rotationRotateCmd = &cobra.Command{
+	Use:   "rotate <namespace>/<bucketaccess>",
+	Short: "Rotate the access key of a bucket access right away",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !strings.Contains(args[0], "/") {
+			return fmt.Errorf("bucket access must be given as <namespace>/<name>")
+		}
+		status := driver.GrantKeyStatus{}
+		if err := rotationRequest(cmd.Context(), http.MethodPost, url.Values{"bucketAccess": []string{args[0]}}, &status); err != nil {
+			return err
+		}
+		printGrantKeyStatus(cmd.OutOrStdout(), status)
+		if status.Error != "" {
+			return fmt.Errorf("rotation of %s failed: %s", args[0], status.Error)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rotationCmd.AddCommand(rotationStatusCmd, rotationRotateCmd)
+	cmd.AddCommand(rotationCmd)
+}
+
+// rotationRequest calls the rotation status endpoint of the driver running with the same flags
+func rotationRequest(ctx context.Context, method string, query url.Values, result interface{}) error {
+	if RotationStatusAddress == "" {
+		return fmt.Errorf("the rotation status endpoint is disabled, set --rotation_status_address")
+	}
+	u := url.URL{Scheme: "http", Host: RotationStatusAddress, Path: driver.RotationStatusPath, RawQuery: query.Encode()}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the driver, is the rotation enabled with --grant_key_rotation_interval? %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, result)
+}
+
+func printGrantKeyStatus(w io.Writer, g driver.GrantKeyStatus) {
+	if g.Error != "" {
+		fmt.Fprintf(w, "%s\tuser %s\terror: %s\n", g.BucketAccess, g.AccountID, g.Error)
+		return
+	}
+	fmt.Fprintf(w, "%s\tuser %s\tkey %s", g.BucketAccess, g.AccountID, g.AccessKeyID)
+	if g.AgeUnknown {
+		fmt.Fprintf(w, "\tcreation time unknown, rotated on request only")
+	} else {
+		fmt.Fprintf(w, "\tcreated %s\trotated after %s", g.KeyCreatedAt.Format(time.RFC3339), g.NextRotation.Format(time.RFC3339))
+	}
+	if len(g.RetiringKeys) > 0 {
+		fmt.Fprintf(w, "\tretiring %s", strings.Join(g.RetiringKeys, ","))
+	}
+	if g.AwaitingAcknowledgement {
+		fmt.Fprintf(w, "\tawaiting acknowledgement")
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,163 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// groupsEndpoint is the Prism Central entity query API listing the object stores
+	groupsEndpoint = "/oss/api/nutanix/v3/groups"
+	// objectStoreCertificateEndpoint is formatted with the object store UUID
+	objectStoreCertificateEndpoint = "/oss/api/nutanix/v3/objectstores/%s/certificate"
+
+	objectStoreEntityType = "objectstore"
+)
+
+var (
+	errMissingObjectStoreName = errors.New("object store name not set")
+
+	// ErrObjectStoreNotFound is returned by GetObjectStoreByName when there is no such object store
+	ErrObjectStoreNotFound = errors.New("object store not found")
+	// ErrNoClientAccessIP is returned by ObjectStore.S3Endpoint when the object store has no client access IP
+	ErrNoClientAccessIP = errors.New("object store has no client access IP")
+)
+
+// ObjectStore is a Nutanix Object Store instance as listed by Prism Central
+type ObjectStore struct {
+	UUID   string
+	Name   string
+	Domain string
+	State  string
+	// ClientAccessIPs are the IPs serving the S3 API on the client access network
+	ClientAccessIPs []string
+}
+
+// S3Endpoint returns the endpoint of the S3 API on the first client access IP.
+// scheme is "http" or "https", "https" when empty, and port defaults to the port of the scheme when 0.
+func (o ObjectStore) S3Endpoint(scheme string, port int) (string, error) {
+	if len(o.ClientAccessIPs) == 0 {
+		return "", ErrNoClientAccessIP
+	}
+	switch scheme {
+	case "", "https":
+		scheme = "https"
+		if port == 0 {
+			port = 443
+		}
+	case "http":
+		if port == 0 {
+			port = 80
+		}
+	default:
+		return "", fmt.Errorf("invalid endpoint scheme %q: must be http or https", scheme)
+	}
+	if port < 0 || port > 65535 {
+		return "", fmt.Errorf("invalid endpoint port %d", port)
+	}
+	return scheme + "://" + net.JoinHostPort(o.ClientAccessIPs[0], strconv.Itoa(port)), nil
+}
+
+type groupsRequest struct {
+	EntityType            string            `json:"entity_type"`
+	FilterCriteria        string            `json:"filter_criteria,omitempty"`
+	GroupMemberAttributes []groupsAttribute `json:"group_member_attributes"`
+}
+
+type groupsAttribute struct {
+	Attribute string `json:"attribute"`
+}
+
+type groupsResponse struct {
+	GroupResults []struct {
+		EntityResults []struct {
+			EntityID string `json:"entity_id"`
+			Data     []struct {
+				Name   string `json:"name"`
+				Values []struct {
+					Values []string `json:"values"`
+				} `json:"values"`
+			} `json:"data"`
+		} `json:"entity_results"`
+	} `json:"group_results"`
+}
+
+type objectStoreCertificate struct {
+	CACert string `json:"ca"`
+}
+
+// GetObjectStoreByName returns the object store with the given name.
+// ErrObjectStoreNotFound is returned when there is no such object store.
+func (api *API) GetObjectStoreByName(ctx context.Context, name string) (ObjectStore, error) {
+	if name == "" {
+		return ObjectStore{}, errMissingObjectStoreName
+	}
+
+	query := &groupsRequest{
+		EntityType:     objectStoreEntityType,
+		FilterCriteria: "name==" + name,
+		GroupMemberAttributes: []groupsAttribute{
+			{Attribute: "name"},
+			{Attribute: "domain"},
+			{Attribute: "state"},
+			{Attribute: "client_access_network_ip_used_list"},
+		},
+	}
+	result := groupsResponse{}
+	if err := api.pcRequest(ctx, http.MethodPost, api.PCEndpoint+groupsEndpoint, query, &result, http.StatusOK); err != nil {
+		return ObjectStore{}, err
+	}
+
+	// the filter is not guaranteed to be an exact match, check the name of every result
+	for _, group := range result.GroupResults {
+		for _, entity := range group.EntityResults {
+			store := ObjectStore{UUID: entity.EntityID}
+			for _, attribute := range entity.Data {
+				var values []string
+				for _, v := range attribute.Values {
+					values = append(values, v.Values...)
+				}
+				if len(values) == 0 {
+					continue
+				}
+				switch attribute.Name {
+				case "name":
+					store.Name = values[0]
+				case "domain":
+					store.Domain = values[0]
+				case "state":
+					store.State = values[0]
+				case "client_access_network_ip_used_list":
+					store.ClientAccessIPs = values
+				}
+			}
+			if store.Name == name {
+				return store, nil
+			}
+		}
+	}
+	return ObjectStore{}, ErrObjectStoreNotFound
+}
+
+// GetObjectStoreCACert returns the PEM encoded CA certificate of the S3 endpoint of the object store
+// with the given UUID, "" when the object store serves a certificate of a public CA
+func (api *API) GetObjectStoreCACert(ctx context.Context, uuid string) (string, error) {
+	if uuid == "" {
+		return "", errMissingObjectStoreUUID
+	}
+
+	result := objectStoreCertificate{}
+	url := api.PCEndpoint + fmt.Sprintf(objectStoreCertificateEndpoint, uuid)
+	if err := api.pcRequest(ctx, http.MethodGet, url, nil, &result, http.StatusOK); err != nil {
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	return result.CACert, nil
+}
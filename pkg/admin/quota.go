@@ -0,0 +1,83 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const (
+	// bucketQuotaEndpoint is the quota of a bucket in the Objects v3 API of Prism Central, the API
+	// under /oss/api/nutanix/v3 that also serves the objectstores and groups calls of objectstore.go.
+	// It is formatted with the object store UUID and the bucket name.
+	bucketQuotaEndpoint = "/oss/api/nutanix/v3/objectstores/%s/buckets/%s/quota"
+
+	// QuotaEnforcementHard rejects writes once the bucket reaches its quota
+	QuotaEnforcementHard = "HARD"
+)
+
+var (
+	errMissingBucketName      = errors.New("bucket name not set")
+	errMissingObjectStoreUUID = errors.New("object store UUID not set")
+)
+
+// BucketQuota is the storage quota of a single bucket
+type BucketQuota struct {
+	// SizeBytes is the quota size, 0 means the bucket has no quota
+	SizeBytes       int64  `json:"size_bytes"`
+	EnforcementType string `json:"enforcement_type"`
+}
+
+func (api *API) bucketQuotaURL(bucket string) (string, error) {
+	if bucket == "" {
+		return "", errMissingBucketName
+	}
+	if api.ObjectStoreUUID == "" {
+		return "", errMissingObjectStoreUUID
+	}
+	return api.PCEndpoint + fmt.Sprintf(bucketQuotaEndpoint, api.ObjectStoreUUID, bucket), nil
+}
+
+// GetBucketQuota returns the quota of the bucket.
+// A bucket without quota has no quota resource, it is reported with a SizeBytes of 0.
+func (api *API) GetBucketQuota(ctx context.Context, bucket string) (BucketQuota, error) {
+	result := BucketQuota{}
+	url, err := api.bucketQuotaURL(bucket)
+	if err != nil {
+		return result, err
+	}
+
+	if err := api.pcRequest(ctx, http.MethodGet, url, nil, &result, http.StatusOK); err != nil {
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound {
+			return BucketQuota{}, nil
+		}
+		return result, err
+	}
+	return result, nil
+}
+
+// SetBucketQuota sets a hard quota of sizeBytes on the bucket
+func (api *API) SetBucketQuota(ctx context.Context, bucket string, sizeBytes int64) error {
+	url, err := api.bucketQuotaURL(bucket)
+	if err != nil {
+		return err
+	}
+
+	quota := &BucketQuota{
+		SizeBytes:       sizeBytes,
+		EnforcementType: QuotaEnforcementHard,
+	}
+	return api.pcRequest(ctx, http.MethodPut, url, quota, nil, http.StatusOK, http.StatusAccepted, http.StatusNoContent)
+}
+
+// ClearBucketQuota removes the quota of the bucket
+func (api *API) ClearBucketQuota(ctx context.Context, bucket string) error {
+	url, err := api.bucketQuotaURL(bucket)
+	if err != nil {
+		return err
+	}
+
+	return api.pcRequest(ctx, http.MethodDelete, url, nil, nil, http.StatusOK, http.StatusAccepted, http.StatusNoContent, http.StatusNotFound)
+}
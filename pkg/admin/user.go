@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 )
 
@@ -15,12 +17,18 @@ const (
 	marshalError   = "failed to marshal ntnx http request body"
 	unmarshalError = "failed to unmarshal ntnx http response"
 	createEndpoint = "/oss/iam_proxy/buckets_access_keys"
-	deleteEndpoint = "/oss/iam_proxy/users/"
+	usersEndpoint  = "/oss/iam_proxy/users/"
+	// userKeysEndpoint creates access keys for the user with the given UUID
+	userKeysEndpoint = usersEndpoint + "%s/buckets_access_keys"
 )
 
 var (
-	errMissingUsername = errors.New("username not set")
-	errMissingUserID   = errors.New("user UUID not set")
+	errMissingUsername    = errors.New("username not set")
+	errMissingUserID      = errors.New("user UUID not set")
+	errMissingAccessKeyID = errors.New("access key ID not set")
+
+	// ErrUserNotFound is returned by the user lookups when the user does not exist
+	ErrUserNotFound = errors.New("user not found")
 )
 
 type NtnxUserReq struct {
@@ -34,20 +42,26 @@ type NtnxUserInfo struct {
 }
 
 type NutanixUserResp struct {
-	Users []struct {
-		BucketsAccessKeys []struct {
-			AccessKeyID     string    `json:"access_key_id"`
-			CreatedTime     time.Time `json:"created_time"`
-			SecretAccessKey string    `json:"secret_access_key"`
-		} `json:"buckets_access_keys"`
-		CreatedTime     time.Time `json:"created_time"`
-		DisplayName     string    `json:"display_name"`
-		LastUpdatedTime time.Time `json:"last_updated_time"`
-		TenantID        string    `json:"tenant_id"`
-		Type            string    `json:"type"`
-		Username        string    `json:"username"`
-		UUID            string    `json:"uuid"`
-	} `json:"users"`
+	Users []NutanixUser `json:"users"`
+}
+
+type NutanixUser struct {
+	BucketsAccessKeys []BucketsAccessKey `json:"buckets_access_keys"`
+	CreatedTime       time.Time          `json:"created_time"`
+	DisplayName       string             `json:"display_name"`
+	LastUpdatedTime   time.Time          `json:"last_updated_time"`
+	TenantID          string             `json:"tenant_id"`
+	Type              string             `json:"type"`
+	Username          string             `json:"username"`
+	UUID              string             `json:"uuid"`
+}
+
+// BucketsAccessKey is an S3 access key of a user.
+// The secret is only returned when the key is created.
+type BucketsAccessKey struct {
+	AccessKeyID     string    `json:"access_key_id"`
+	CreatedTime     time.Time `json:"created_time"`
+	SecretAccessKey string    `json:"secret_access_key"`
 }
 
 type NutanixUserErrorResp struct {
@@ -60,6 +74,17 @@ type NutanixUserErrorResp struct {
 	} `json:"users"`
 }
 
+// UserError is the error reported by the IAM proxy for a single user of a request.
+// Code follows the HTTP status codes, such as 409 for an existing user.
+type UserError struct {
+	Code    int
+	Message string
+}
+
+func (e *UserError) Error() string {
+	return fmt.Sprintf("errorCode : %d, errorMessage : %s", e.Code, e.Message)
+}
+
 // Nutanix IAM User
 func (api *API) CreateUser(ctx context.Context, username, display_name string) (NutanixUserResp, error) {
 	result := NutanixUserResp{}
@@ -88,7 +113,7 @@ func (api *API) CreateUser(ctx context.Context, username, display_name string) (
 	}
 
 	// Send Request
-	request, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+	request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(data))
 	if err != nil {
 		return result, fmt.Errorf("%w", err)
 	}
@@ -103,7 +128,7 @@ func (api *API) CreateUser(ctx context.Context, username, display_name string) (
 
 	// Check respsonse status
 	if resp.StatusCode != 200 {
-		return result, fmt.Errorf("%s", resp.Status)
+		return result, &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
 
 	decodedResponse, err := ioutil.ReadAll(resp.Body)
@@ -117,6 +142,10 @@ func (api *API) CreateUser(ctx context.Context, username, display_name string) (
 		return result, fmt.Errorf("%s. %s. %w", unmarshalError, string(decodedResponse), err)
 	}
 
+	if len(result.Users) == 0 {
+		return result, fmt.Errorf("%s. %s", unmarshalError, string(decodedResponse))
+	}
+
 	// Unmarshal function doesn't return an error if attributes are different from the defined struct
 	// len(result.Users[0].BucketsAccessKeys) equal to 0, implies that new user wasn't created
 	if len(result.Users[0].BucketsAccessKeys) == 0 {
@@ -127,13 +156,109 @@ func (api *API) CreateUser(ctx context.Context, username, display_name string) (
 			return result, fmt.Errorf("%s. %s. %w", unmarshalError, string(decodedResponse), err)
 		}
 
-		return NutanixUserResp{}, fmt.Errorf("errorCode : %d, errorMessage : %s", errorResp.Users[0].Code, errorResp.Users[0].Message)
+		return NutanixUserResp{}, &UserError{Code: errorResp.Users[0].Code, Message: errorResp.Users[0].Message}
 	}
 
 	return result, nil
 }
 
-// RemoveUser removes an user from the object store
+// GetUser returns the user of the object store with the given UUID.
+// ErrUserNotFound is returned when there is no such user.
+func (api *API) GetUser(ctx context.Context, uuid string) (NutanixUser, error) {
+	result := NutanixUser{}
+	if uuid == "" {
+		return result, errMissingUserID
+	}
+
+	userURL := api.PCEndpoint + usersEndpoint + uuid
+	if err := api.pcRequest(ctx, http.MethodGet, userURL, nil, &result, http.StatusOK); err != nil {
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound {
+			return result, ErrUserNotFound
+		}
+		return result, err
+	}
+	return result, nil
+}
+
+// GetUserByName returns the user of the object store with the given username.
+// ErrUserNotFound is returned when there is no such user.
+func (api *API) GetUserByName(ctx context.Context, username string) (NutanixUser, error) {
+	if username == "" {
+		return NutanixUser{}, errMissingUsername
+	}
+
+	result := NutanixUserResp{}
+	query := url.Values{"filter": []string{"username==" + username}}
+	listURL := api.PCEndpoint + strings.TrimSuffix(usersEndpoint, "/") + "?" + query.Encode()
+	if err := api.pcRequest(ctx, http.MethodGet, listURL, nil, &result, http.StatusOK); err != nil {
+		return NutanixUser{}, err
+	}
+
+	// the filter is not guaranteed to be an exact match, check the username of every result
+	for _, u := range result.Users {
+		if u.Username == username {
+			return u, nil
+		}
+	}
+	return NutanixUser{}, ErrUserNotFound
+}
+
+// CreateAccessKey creates a new access key for the user with the given UUID.
+// The keys the user already has stay valid.
+func (api *API) CreateAccessKey(ctx context.Context, uuid string) (BucketsAccessKey, error) {
+	result := BucketsAccessKey{}
+	if uuid == "" {
+		return result, errMissingUserID
+	}
+
+	keysURL := api.PCEndpoint + fmt.Sprintf(userKeysEndpoint, uuid)
+	if err := api.pcRequest(ctx, http.MethodPost, keysURL, struct{}{}, &result, http.StatusOK, http.StatusCreated); err != nil {
+		return result, err
+	}
+	if result.AccessKeyID == "" || result.SecretAccessKey == "" {
+		return result, fmt.Errorf("no access key returned for user %s", uuid)
+	}
+	return result, nil
+}
+
+// ListAccessKeys returns the access keys of the user with the given UUID, without their secrets.
+// ErrUserNotFound is returned when there is no such user.
+func (api *API) ListAccessKeys(ctx context.Context, uuid string) ([]BucketsAccessKey, error) {
+	if uuid == "" {
+		return nil, errMissingUserID
+	}
+
+	result := struct {
+		BucketsAccessKeys []BucketsAccessKey `json:"buckets_access_keys"`
+	}{}
+	keysURL := api.PCEndpoint + fmt.Sprintf(userKeysEndpoint, uuid)
+	if err := api.pcRequest(ctx, http.MethodGet, keysURL, nil, &result, http.StatusOK); err != nil {
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return result.BucketsAccessKeys, nil
+}
+
+// DeleteAccessKey deletes an access key of the user with the given UUID.
+// Deleting a key that does not exist succeeds.
+func (api *API) DeleteAccessKey(ctx context.Context, uuid, accessKeyID string) error {
+	if uuid == "" {
+		return errMissingUserID
+	}
+	if accessKeyID == "" {
+		return errMissingAccessKeyID
+	}
+
+	keyURL := api.PCEndpoint + fmt.Sprintf(userKeysEndpoint, uuid) + "/" + accessKeyID
+	return api.pcRequest(ctx, http.MethodDelete, keyURL, nil, nil, http.StatusOK, http.StatusNoContent, http.StatusNotFound)
+}
+
+// RemoveUser removes an user from the object store.
+// Removing a user that does not exist succeeds.
 func (api *API) RemoveUser(ctx context.Context, uuid string) error {
 
 	if uuid == "" {
@@ -141,8 +266,8 @@ func (api *API) RemoveUser(ctx context.Context, uuid string) error {
 	}
 
 	// Delete API
-	delete_url := api.PCEndpoint + deleteEndpoint + string(uuid)
-	delete_request, err := http.NewRequest("DELETE", delete_url, nil)
+	delete_url := api.PCEndpoint + usersEndpoint + string(uuid)
+	delete_request, err := http.NewRequestWithContext(ctx, "DELETE", delete_url, nil)
 	if err != nil {
 		return fmt.Errorf("%w", err)
 	}
@@ -154,9 +279,11 @@ func (api *API) RemoveUser(ctx context.Context, uuid string) error {
 	}
 	defer delete_resp.Body.Close()
 
-	// Check response status
-	if delete_resp.StatusCode != 204 {
-		return fmt.Errorf("%s", delete_resp.Status)
+	// Check response status, a user that is already gone counts as removed
+	switch delete_resp.StatusCode {
+	case http.StatusNoContent, http.StatusNotFound:
+	default:
+		return &HTTPError{StatusCode: delete_resp.StatusCode, Status: delete_resp.Status}
 	}
 	return nil
 }
@@ -1,8 +1,12 @@
 package admin
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"strings"
@@ -20,6 +24,16 @@ var (
 	errNoPCPassword = errors.New("Prism Central password for IAM user management not set")
 )
 
+// HTTPError is returned when Prism Central answers with an unexpected status
+type HTTPError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPError) Error() string {
+	return e.Status
+}
+
 // HTTPClient interface that conforms to that of the http package's Client.
 type HTTPClient interface {
 	Do(req *http.Request) (*http.Response, error)
@@ -27,17 +41,20 @@ type HTTPClient interface {
 
 // API struct for New Client
 type API struct {
-	AccessKey   string
-	SecretKey   string
 	Endpoint    string
 	PCEndpoint  string
 	PCUsername  string
 	PCPassword  string
 	AccountName string
-	HTTPClient  HTTPClient
+	// ObjectStoreUUID identifies the object store in the Prism Central objects API.
+	// Only required for object store management calls such as bucket quotas.
+	ObjectStoreUUID string
+	HTTPClient      HTTPClient
 }
 
-// New returns client for Nutanix object store
+// New returns client for Nutanix object store.
+// The S3 keys are only validated, the S3 client of the object store is the one holding them,
+// so that a rotation of the keys replaces them in a single place.
 func New(endpoint, accessKey, secretKey, pcEndpoint, pcUsername, pcPassword, accountName, caCert string, insecure bool, httpClient HTTPClient) (*API, error) {
 	// validate endpoint
 	if endpoint == "" {
@@ -54,6 +71,23 @@ func New(endpoint, accessKey, secretKey, pcEndpoint, pcUsername, pcPassword, acc
 		return nil, errNoSecretKey
 	}
 
+	// set default account_name when empty
+	if accountName == "" {
+		accountName = "ntnx-cosi-iam-user"
+	}
+
+	api, err := NewPCClient(pcEndpoint, pcUsername, pcPassword, caCert, insecure, httpClient)
+	if err != nil {
+		return nil, err
+	}
+	api.Endpoint = endpoint
+	api.AccountName = accountName
+	return api, nil
+}
+
+// NewPCClient returns a client limited to the Prism Central calls, such as the object store lookups
+// that take place before the object store endpoint and admin keys are known
+func NewPCClient(pcEndpoint, pcUsername, pcPassword, caCert string, insecure bool, httpClient HTTPClient) (*API, error) {
 	// validate pc endpoint
 	if pcEndpoint == "" {
 		return nil, errNoPCEndpoint
@@ -69,36 +103,82 @@ func New(endpoint, accessKey, secretKey, pcEndpoint, pcUsername, pcPassword, acc
 		return nil, errNoPCPassword
 	}
 
-	// set default account_name when empty
-	if accountName == "" {
-		accountName = "ntnx-cosi-iam-user"
+	if httpClient == nil {
+		tlsConfig := transport.TlsConfig{
+			CACert:   caCert,
+			Insecure: insecure,
+			Endpoint: pcEndpoint,
+		}
+
+		transport, err := transport.BuildTransportTLS(tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		httpClient = &http.Client{
+			Timeout:   time.Second * 15,
+			Transport: transport,
+		}
 	}
 
-	tlsConfig := transport.TlsConfig{
-		CACert:   caCert,
-		Insecure: insecure,
-		Endpoint: pcEndpoint,
+	return &API{
+		PCEndpoint: pcEndpoint,
+		PCUsername: pcUsername,
+		PCPassword: pcPassword,
+		HTTPClient: httpClient,
+	}, nil
+}
+
+// pcRequest sends a request to Prism Central authenticated with the PC credentials.
+// body is sent as json when not nil, the json response is decoded into result when not nil.
+// An error is returned when the response status is not one of expected.
+func (api *API) pcRequest(ctx context.Context, method, url string, body, result interface{}, expected ...int) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("%s. %w", marshalError, err)
+		}
+		reader = bytes.NewBuffer(data)
 	}
 
-	transport, err := transport.BuildTransportTLS(tlsConfig)
+	request, err := http.NewRequestWithContext(ctx, method, url, reader)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("%w", err)
 	}
-	client := &http.Client{
-		Timeout:   time.Second * 15,
-		Transport: transport,
+	request.SetBasicAuth(api.PCUsername, api.PCPassword)
+	if body != nil {
+		request.Header.Add("Content-Type", "application/json")
 	}
 
-	return &API{
-		Endpoint:    endpoint,
-		AccessKey:   accessKey,
-		SecretKey:   secretKey,
-		PCEndpoint:  pcEndpoint,
-		PCUsername:  pcUsername,
-		PCPassword:  pcPassword,
-		AccountName: accountName,
-		HTTPClient:  client,
-	}, nil
+	resp, err := api.HTTPClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	defer resp.Body.Close()
+
+	decodedResponse, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	// Check response status
+	ok := false
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	if result != nil && len(decodedResponse) > 0 {
+		if err := json.Unmarshal(decodedResponse, result); err != nil {
+			return fmt.Errorf("%s. %s. %w", unmarshalError, string(decodedResponse), err)
+		}
+	}
+	return nil
 }
 
 func GetCredsFromPCSecret(key string) (string, string, string, error) {
@@ -0,0 +1,396 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	ntnxIam "github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/admin"
+	"github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/util/kube"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultServiceUsername is the IAM user created by the bootstrap mode for the driver itself
+	DefaultServiceUsername = "ntnx-cosi-driver@nutanix.com"
+	// DefaultKeyRotationInterval is how often the bootstrap mode replaces the keys of the service user
+	DefaultKeyRotationInterval = 30 * 24 * time.Hour
+	// DefaultKeyOverlap is how long the previous key of the service user stays valid after a rotation
+	DefaultKeyOverlap = time.Hour
+
+	// serviceUserDisplayName is the display name of the service user
+	serviceUserDisplayName = "ntnx-cosi-driver"
+	// keyRotationCheckInterval is how often the age of the service user keys is checked
+	keyRotationCheckInterval = time.Hour
+
+	// Keys of the credentials in the Secret, they match the environment variables of the driver
+	// so that the objectstorage-provisioner Secret itself can hold them
+	secretAccessKey = "ACCESS_KEY"
+	secretSecretKey = "SECRET_KEY"
+	secretCreatedAt = "ACCESS_KEY_CREATED_AT"
+	secretRetiring  = "RETIRING_ACCESS_KEY"
+)
+
+// Credentials are the S3 access keys of the driver
+type Credentials struct {
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey"`
+	// CreatedAt is when the keys were created, it schedules their rotation
+	CreatedAt time.Time `json:"createdAt"`
+	// RetiringKey is the access key replaced by the last rotation, it is deleted once the overlap is over
+	RetiringKey string `json:"retiringKey,omitempty"`
+}
+
+// CredentialStore persists the credentials created by the bootstrap mode
+type CredentialStore interface {
+	// Load returns the stored credentials, found is false when there are none
+	Load(ctx context.Context) (creds Credentials, found bool, err error)
+	Save(ctx context.Context, creds Credentials) error
+}
+
+// NewCredentialStore returns the store of location, either "file:<path>" or "secret:[<namespace>/]<name>".
+// Secrets without namespace are looked up in the namespace of the driver pod.
+func NewCredentialStore(location string) (CredentialStore, error) {
+	kind, ref, _ := strings.Cut(location, ":")
+	switch {
+	case ref == "":
+	case kind == "file":
+		return &fileCredentialStore{path: ref}, nil
+	case kind == "secret":
+		namespace, name, found := strings.Cut(ref, "/")
+		if !found {
+			ns, err := kube.Namespace()
+			if err != nil {
+				return nil, err
+			}
+			namespace, name = ns, ref
+		}
+		clients, err := kube.NewInClusterClients()
+		if err != nil {
+			return nil, err
+		}
+		return &secretCredentialStore{client: clients.Core, namespace: namespace, name: name}, nil
+	}
+	return nil, fmt.Errorf("invalid credentials location %q, must be file:<path> or secret:[<namespace>/]<name>", location)
+}
+
+// fileCredentialStore keeps the credentials in a json file
+type fileCredentialStore struct {
+	path string
+}
+
+func (f *fileCredentialStore) Load(_ context.Context) (Credentials, bool, error) {
+	creds := Credentials{}
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return creds, false, nil
+	}
+	if err != nil {
+		return creds, false, fmt.Errorf("failed to read credentials: %w", err)
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return creds, false, fmt.Errorf("invalid credentials file %q: %w", f.path, err)
+	}
+	return creds, creds.AccessKey != "" && creds.SecretKey != "", nil
+}
+
+// Save replaces the file in one step, so that a crash never leaves it half written
+func (f *fileCredentialStore) Save(_ context.Context, creds Credentials) error {
+	data, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to save credentials: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save credentials: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save credentials: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("failed to save credentials: %w", err)
+	}
+	return nil
+}
+
+// secretCredentialStore keeps the credentials in the ACCESS_KEY and SECRET_KEY keys of a Secret
+type secretCredentialStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+func (s *secretCredentialStore) Load(ctx context.Context) (Credentials, bool, error) {
+	secret, err := s.client.CoreV1().Secrets(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return Credentials{}, false, nil
+	}
+	if err != nil {
+		return Credentials{}, false, fmt.Errorf("failed to read secret %s/%s: %w", s.namespace, s.name, err)
+	}
+	data := secret.Data
+	creds := Credentials{
+		AccessKey:   string(data[secretAccessKey]),
+		SecretKey:   string(data[secretSecretKey]),
+		RetiringKey: string(data[secretRetiring]),
+	}
+	if createdAt, ok := data[secretCreatedAt]; ok {
+		if creds.CreatedAt, err = time.Parse(time.RFC3339, string(createdAt)); err != nil {
+			return creds, false, fmt.Errorf("invalid %s in secret %s/%s: %w", secretCreatedAt, s.namespace, s.name, err)
+		}
+	}
+	return creds, creds.AccessKey != "" && creds.SecretKey != "", nil
+}
+
+func (s *secretCredentialStore) Save(ctx context.Context, creds Credentials) error {
+	err := kube.UpdateSecretData(ctx, s.client, s.namespace, s.name, map[string][]byte{
+		secretAccessKey: []byte(creds.AccessKey),
+		secretSecretKey: []byte(creds.SecretKey),
+		secretCreatedAt: []byte(creds.CreatedAt.Format(time.RFC3339)),
+		secretRetiring:  []byte(creds.RetiringKey),
+	}, true)
+	if err != nil {
+		return fmt.Errorf("failed to save secret %s/%s: %w", s.namespace, s.name, err)
+	}
+	return nil
+}
+
+// BootstrapOptions enables the bootstrap mode, in which the driver creates its own IAM user
+// through Prism Central instead of being configured with admin keys
+type BootstrapOptions struct {
+	// Store persists the keys of the service user across restarts
+	Store CredentialStore
+	// Username is the IAM username of the service user, DefaultServiceUsername is used when it is empty
+	Username string
+	// RotationInterval is how often the keys of the service user are replaced, 0 disables the rotation
+	RotationInterval time.Duration
+	// KeyOverlap is how long the previous key stays valid after a rotation, DefaultKeyOverlap is used when it is 0.
+	// It must be shorter than RotationInterval.
+	KeyOverlap time.Duration
+}
+
+func (b *BootstrapOptions) username() string {
+	if b.Username == "" {
+		return DefaultServiceUsername
+	}
+	return b.Username
+}
+
+func (b *BootstrapOptions) keyOverlap() time.Duration {
+	if b.KeyOverlap == 0 {
+		return DefaultKeyOverlap
+	}
+	return b.KeyOverlap
+}
+
+func (b *BootstrapOptions) validate() error {
+	if err := validateUsername(b.username()); err != nil {
+		return fmt.Errorf("invalid service username: %w", err)
+	}
+	if b.KeyOverlap < 0 {
+		return fmt.Errorf("key overlap cannot be negative")
+	}
+	if b.RotationInterval > 0 && b.keyOverlap() >= b.RotationInterval {
+		return fmt.Errorf("key overlap %s must be shorter than the key rotation interval %s", b.keyOverlap(), b.RotationInterval)
+	}
+	return nil
+}
+
+// bootstrapCredentials returns the stored keys of the service user. On first start the service user is
+// created, or given a new key when it already exists, and its keys are stored before they are used.
+// The keys of the service user missing from the store, left by lost stores or failed saves, are deleted.
+func bootstrapCredentials(ctx context.Context, api *ntnxIam.API, b *BootstrapOptions) (Credentials, error) {
+	if err := b.validate(); err != nil {
+		return Credentials{}, err
+	}
+	creds, found, err := b.Store.Load(ctx)
+	if err != nil {
+		return creds, err
+	}
+	if found {
+		klog.InfoS("Using stored service user credentials", "userName", b.username(), "accessKeyID", creds.AccessKey)
+		if creds.CreatedAt.IsZero() {
+			// keys stored without creation time are rotated one interval from now
+			creds.CreatedAt = time.Now()
+		}
+		user, err := api.GetUserByName(ctx, b.username())
+		if err != nil {
+			// the stored keys may still work, such as for a user created outside of Prism Central
+			klog.ErrorS(err, "failed to look up service user, its unused keys are kept", "userName", b.username())
+			return creds, nil
+		}
+		pruneServiceKeys(ctx, api, b, user.UUID, creds)
+		return creds, nil
+	}
+
+	var key ntnxIam.BucketsAccessKey
+	user, err := api.GetUserByName(ctx, b.username())
+	switch {
+	case errors.Is(err, ntnxIam.ErrUserNotFound):
+		resp, err := api.CreateUser(ctx, b.username(), serviceUserDisplayName)
+		if err != nil {
+			return creds, fmt.Errorf("failed to create service user: %w", err)
+		}
+		user, key = resp.Users[0], resp.Users[0].BucketsAccessKeys[0]
+		klog.InfoS("Created service user", "userName", b.username(), "id", user.UUID)
+	case err != nil:
+		return creds, fmt.Errorf("failed to look up service user: %w", err)
+	default:
+		// the keys of an earlier start were lost, the user gets a new one and the lost ones are deleted below
+		if key, err = api.CreateAccessKey(ctx, user.UUID); err != nil {
+			return creds, fmt.Errorf("failed to create service user access key: %w", err)
+		}
+		klog.InfoS("Created access key for existing service user", "userName", b.username(), "id", user.UUID)
+	}
+
+	creds = Credentials{AccessKey: key.AccessKeyID, SecretKey: key.SecretAccessKey, CreatedAt: time.Now()}
+	if err := b.Store.Save(ctx, creds); err != nil {
+		// a key that cannot be stored would be lost on restart
+		if err := api.DeleteAccessKey(ctx, user.UUID, key.AccessKeyID); err != nil {
+			klog.ErrorS(err, "failed to delete unsaved service user access key", "userName", b.username())
+		}
+		return Credentials{}, err
+	}
+	pruneServiceKeys(ctx, api, b, user.UUID, creds)
+	return creds, nil
+}
+
+// pruneServiceKeys deletes the access keys of the service user other than the stored ones.
+// Failures are only logged, the keys are pruned again on the next start.
+func pruneServiceKeys(ctx context.Context, api *ntnxIam.API, b *BootstrapOptions, userID string, creds Credentials) {
+	keys, err := api.ListAccessKeys(ctx, userID)
+	if err != nil {
+		klog.ErrorS(err, "failed to list service user access keys", "userName", b.username())
+		return
+	}
+	for _, key := range keys {
+		if key.AccessKeyID == creds.AccessKey || key.AccessKeyID == creds.RetiringKey {
+			continue
+		}
+		if err := api.DeleteAccessKey(ctx, userID, key.AccessKeyID); err != nil {
+			klog.ErrorS(err, "failed to delete unstored service user access key", "userName", b.username(), "accessKeyID", key.AccessKeyID)
+			continue
+		}
+		klog.InfoS("Deleted unstored service user access key", "userName", b.username(), "accessKeyID", key.AccessKeyID)
+	}
+}
+
+// rotateCredentials gives the service user a new access key, stores it and switches the object store to it.
+// The previous key is stored as retiring, it stays valid for the overlap so that requests signed with it,
+// such as those of driver commands started before the rotation, still succeed.
+func (o *objectStore) rotateCredentials(ctx context.Context, b *BootstrapOptions, current Credentials) (Credentials, error) {
+	if current.RetiringKey != "" {
+		// the key retired by an earlier rotation is deleted first, the service user keeps at most two keys
+		var err error
+		if current, err = o.retireCredentials(ctx, b, current); err != nil {
+			return current, err
+		}
+	}
+
+	user, err := o.ntnxIamClient.GetUserByName(ctx, b.username())
+	if err != nil {
+		return current, fmt.Errorf("failed to look up service user: %w", err)
+	}
+	key, err := o.ntnxIamClient.CreateAccessKey(ctx, user.UUID)
+	if err != nil {
+		return current, fmt.Errorf("failed to create service user access key: %w", err)
+	}
+
+	creds := Credentials{
+		AccessKey:   key.AccessKeyID,
+		SecretKey:   key.SecretAccessKey,
+		CreatedAt:   time.Now(),
+		RetiringKey: current.AccessKey,
+	}
+	if err := b.Store.Save(ctx, creds); err != nil {
+		if err := o.ntnxIamClient.DeleteAccessKey(ctx, user.UUID, key.AccessKeyID); err != nil {
+			klog.ErrorS(err, "failed to delete unsaved service user access key", "userName", b.username())
+		}
+		return current, err
+	}
+	// the S3 client is the only holder of the keys, the IAM client authenticates with Prism Central
+	o.s3Client.SetCredentials(creds.AccessKey, creds.SecretKey)
+	klog.InfoS("Rotated service user access key", "userName", b.username(), "accessKeyID", creds.AccessKey,
+		"retiringKey", creds.RetiringKey, "overlap", b.keyOverlap())
+	return creds, nil
+}
+
+// retireCredentials deletes the retiring key of the service user and removes it from the store
+func (o *objectStore) retireCredentials(ctx context.Context, b *BootstrapOptions, current Credentials) (Credentials, error) {
+	user, err := o.ntnxIamClient.GetUserByName(ctx, b.username())
+	if err != nil {
+		return current, fmt.Errorf("failed to look up service user: %w", err)
+	}
+	if err := o.ntnxIamClient.DeleteAccessKey(ctx, user.UUID, current.RetiringKey); err != nil {
+		return current, fmt.Errorf("failed to delete previous service user access key %s: %w", current.RetiringKey, err)
+	}
+	klog.InfoS("Deleted previous service user access key", "userName", b.username(), "accessKeyID", current.RetiringKey)
+
+	creds := current
+	creds.RetiringKey = ""
+	if err := b.Store.Save(ctx, creds); err != nil {
+		// the deleted key stays in the store until the next save, deleting it again succeeds
+		klog.ErrorS(err, "failed to remove previous service user access key from the store", "userName", b.username())
+	}
+	return creds, nil
+}
+
+// runKeyRotation rotates the keys of the service user once they are b.RotationInterval old, and deletes
+// the retiring key once the overlap is over, until ctx is done. The age of the keys is stored along with them,
+// so that restarts of the driver do not postpone the rotation.
+func (o *objectStore) runKeyRotation(ctx context.Context, b *BootstrapOptions, creds Credentials) {
+	interval := min(keyRotationCheckInterval, b.keyOverlap())
+	if b.RotationInterval > 0 {
+		interval = min(interval, b.RotationInterval)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		if creds.RetiringKey != "" && time.Since(creds.CreatedAt) >= b.keyOverlap() {
+			if creds, err = o.retireCredentials(ctx, b, creds); err != nil {
+				klog.ErrorS(err, "failed to retire service user access key", "userName", b.username())
+			}
+		}
+		if b.RotationInterval > 0 && time.Since(creds.CreatedAt) >= b.RotationInterval {
+			if creds, err = o.rotateCredentials(ctx, b, creds); err != nil {
+				klog.ErrorS(err, "failed to rotate service user access key", "userName", b.username())
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/util/kube"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	cosiapi "sigs.k8s.io/container-object-storage-interface-api/apis/objectstorage/v1alpha1"
+)
+
+const (
+	// CABundleConfigMapSuffix is appended to the name of the BucketAccess Secret to name the ConfigMap
+	// holding the CA bundle of the object store
+	CABundleConfigMapSuffix = "-ca"
+	// CABundleKey is the key of the CA bundle in the ConfigMap
+	CABundleKey = "ca.crt"
+
+	// caBundleSyncInterval is how often the CA bundle ConfigMaps are written
+	caBundleSyncInterval = time.Minute
+)
+
+// caBundlePublisher writes the CA bundle of the object store of each BucketAccess of the driver to a ConfigMap
+// next to its Secret. The COSI sidecar only copies the endpoint, region and keys to the BucketInfo of the Secret,
+// so the bundle cannot be returned with the credentials of the grant.
+type caBundlePublisher struct {
+	provisioner  string
+	objectStores *objectStoreRegistry
+	kube         *kube.Clients
+}
+
+func newCABundlePublisher(provisioner string, objectStores *objectStoreRegistry, clients *kube.Clients) *caBundlePublisher {
+	return &caBundlePublisher{
+		provisioner:  provisioner,
+		objectStores: objectStores,
+		kube:         clients,
+	}
+}
+
+// run publishes the CA bundles every caBundleSyncInterval until ctx is done,
+// so that new grants and refreshed certificates reach their ConfigMaps
+func (p *caBundlePublisher) run(ctx context.Context) {
+	ticker := time.NewTicker(caBundleSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.publishAll(ctx); err != nil {
+			klog.ErrorS(err, "failed to publish object store CA bundles")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishAll writes the CA bundle ConfigMap of every granted BucketAccess of the driver whose object store
+// has a CA bundle. The failures of single BucketAccesses are logged, the others are still published.
+func (p *caBundlePublisher) publishAll(ctx context.Context) error {
+	classes, err := p.kube.COSI.ObjectstorageV1alpha1().BucketAccessClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list BucketAccessClasses: %w", err)
+	}
+	ours := map[string]bool{}
+	for _, c := range classes.Items {
+		ours[c.Name] = strings.EqualFold(c.DriverName, p.provisioner)
+	}
+
+	accesses, err := p.kube.COSI.ObjectstorageV1alpha1().BucketAccesses(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list BucketAccesses: %w", err)
+	}
+	for _, ba := range accesses.Items {
+		if !ours[ba.Spec.BucketAccessClassName] || !ba.Status.AccessGranted || ba.Spec.CredentialsSecretName == "" {
+			continue
+		}
+		if err := p.publish(ctx, &ba); err != nil {
+			klog.ErrorS(err, "failed to publish object store CA bundle", "bucketAccess", ba.Namespace+"/"+ba.Name)
+		}
+	}
+	return nil
+}
+
+// publish writes the CA bundle of the object store of the bucket of ba, the ConfigMap is owned by ba
+// so that it is deleted along with it
+func (p *caBundlePublisher) publish(ctx context.Context, ba *cosiapi.BucketAccess) error {
+	store, err := p.objectStores.forBucketAccess(ctx, p.kube.COSI, ba)
+	if err != nil {
+		return err
+	}
+	caBundle := store.currentCABundle()
+	if len(caBundle) == 0 {
+		return nil
+	}
+
+	name := ba.Spec.CredentialsSecretName + CABundleConfigMapSuffix
+	owner := metav1.OwnerReference{
+		APIVersion: cosiapi.SchemeGroupVersion.String(),
+		Kind:       "BucketAccess",
+		Name:       ba.Name,
+		UID:        ba.UID,
+	}
+	if err := kube.ApplyConfigMapData(ctx, p.kube.Core, ba.Namespace, name, map[string]string{CABundleKey: string(caBundle)}, owner); err != nil {
+		return fmt.Errorf("failed to write ConfigMap %s/%s: %w", ba.Namespace, name, err)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/util/kube"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	cosiapi "sigs.k8s.io/container-object-storage-interface-api/apis/objectstorage/v1alpha1"
+	cosifake "sigs.k8s.io/container-object-storage-interface-api/client/clientset/versioned/fake"
+)
+
+const testProvisioner = "ntnx.objectstorage.k8s.io"
+
+// grantObjects returns a BucketAccess granted by class on a bucket of the given BucketId, with its claim and bucket
+func grantObjects(namespace, name, class, bucketID string, granted bool) []runtime.Object {
+	return []runtime.Object{
+		&cosiapi.BucketAccess{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: types.UID("uid-" + name)},
+			Spec: cosiapi.BucketAccessSpec{
+				BucketClaimName:       name + "-claim",
+				BucketAccessClassName: class,
+				CredentialsSecretName: name + "-creds",
+			},
+			Status: cosiapi.BucketAccessStatus{AccessGranted: granted, AccountID: "ba-" + name},
+		},
+		&cosiapi.BucketClaim{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name + "-claim"},
+			Status:     cosiapi.BucketClaimStatus{BucketReady: true, BucketName: name + "-bucket"},
+		},
+		&cosiapi.Bucket{
+			ObjectMeta: metav1.ObjectMeta{Name: name + "-bucket"},
+			Status:     cosiapi.BucketStatus{BucketReady: true, BucketID: bucketID},
+		},
+	}
+}
+
+func testObjectStore(name string, caBundle string) *objectStore {
+	o := &objectStore{name: name}
+	o.s3CACert.Store([]byte(caBundle))
+	return o
+}
+
+func TestPublishCABundles(t *testing.T) {
+	objects := []runtime.Object{
+		&cosiapi.BucketAccessClass{ObjectMeta: metav1.ObjectMeta{Name: "ntnx"}, DriverName: testProvisioner},
+		&cosiapi.BucketAccessClass{ObjectMeta: metav1.ObjectMeta{Name: "other"}, DriverName: "other.objectstorage.k8s.io"},
+	}
+	objects = append(objects, grantObjects("ns-a", "default-store", "ntnx", "bucket-a", true)...)
+	objects = append(objects, grantObjects("ns-a", "named-store", "ntnx", "store-b/bucket-b", true)...)
+	objects = append(objects, grantObjects("ns-a", "no-ca", "ntnx", "store-c/bucket-c", true)...)
+	objects = append(objects, grantObjects("ns-b", "pending", "ntnx", "bucket-d", false)...)
+	objects = append(objects, grantObjects("ns-b", "other-driver", "other", "bucket-e", true)...)
+
+	stores, err := newObjectStoreRegistry("",
+		testObjectStore("", "ca-default"), testObjectStore("store-b", "ca-b"), testObjectStore("store-c", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	core := fake.NewSimpleClientset()
+	p := newCABundlePublisher(testProvisioner, stores, &kube.Clients{Core: core, COSI: cosifake.NewSimpleClientset(objects...)})
+
+	if err := p.publishAll(context.Background()); err != nil {
+		t.Fatalf("publishAll() error = %v", err)
+	}
+
+	tests := []struct {
+		namespace string
+		name      string
+		want      string
+	}{
+		{namespace: "ns-a", name: "default-store-creds-ca", want: "ca-default"},
+		{namespace: "ns-a", name: "named-store-creds-ca", want: "ca-b"},
+		{namespace: "ns-a", name: "no-ca-creds-ca"},
+		{namespace: "ns-b", name: "pending-creds-ca"},
+		{namespace: "ns-b", name: "other-driver-creds-ca"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm, err := core.CoreV1().ConfigMaps(tt.namespace).Get(context.Background(), tt.name, metav1.GetOptions{})
+			if tt.want == "" {
+				if !apierrors.IsNotFound(err) {
+					t.Fatalf("ConfigMap %s/%s error = %v, want NotFound", tt.namespace, tt.name, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cm.Data[CABundleKey]; got != tt.want {
+				t.Errorf("%s = %q, want %q", CABundleKey, got, tt.want)
+			}
+			if len(cm.OwnerReferences) != 1 || cm.OwnerReferences[0].Kind != "BucketAccess" {
+				t.Errorf("owners = %+v, want the BucketAccess", cm.OwnerReferences)
+			}
+		})
+	}
+}
+
+func TestPublishCABundleRefresh(t *testing.T) {
+	objects := append([]runtime.Object{
+		&cosiapi.BucketAccessClass{ObjectMeta: metav1.ObjectMeta{Name: "ntnx"}, DriverName: testProvisioner},
+	}, grantObjects("ns", "ba", "ntnx", "bucket", true)...)
+	store := testObjectStore("", "ca-1")
+	stores, err := newObjectStoreRegistry("", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	core := fake.NewSimpleClientset()
+	p := newCABundlePublisher(testProvisioner, stores, &kube.Clients{Core: core, COSI: cosifake.NewSimpleClientset(objects...)})
+
+	for _, caBundle := range []string{"ca-1", "ca-1", "ca-2"} {
+		store.s3CACert.Store([]byte(caBundle))
+		if err := p.publishAll(context.Background()); err != nil {
+			t.Fatalf("publishAll() error = %v", err)
+		}
+		cm, err := core.CoreV1().ConfigMaps("ns").Get(context.Background(), "ba-creds-ca", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cm.Data[CABundleKey]; got != caBundle {
+			t.Errorf("%s = %q, want %q", CABundleKey, got, caBundle)
+		}
+	}
+
+	// the unchanged bundle is not written again
+	updates := 0
+	for _, a := range core.Actions() {
+		if a.GetVerb() == "update" {
+			updates++
+		}
+	}
+	if updates != 1 {
+		t.Errorf("ConfigMap updates = %d, want 1", updates)
+	}
+}
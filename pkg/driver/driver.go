@@ -19,31 +19,191 @@ package driver
 import (
 	"context"
 	"fmt"
+	"time"
 
 	ntnxIam "github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/admin"
-	"github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/util/s3client"
-	"k8s.io/klog/v2"
+	"github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/util/kube"
 )
 
+// DefaultRegion is the region returned in the credentials of grants when none is configured
+const DefaultRegion = "us-east-1"
+
+// Options holds the optional settings of the driver
+type Options struct {
+	// LifecycleConfigDir is the directory holding the lifecycle documents that
+	// BucketClasses reference through the lifecycleConfigRef parameter
+	LifecycleConfigDir string
+	// ObjectStoreUUID identifies the object store in the Prism Central objects API,
+	// it is required for bucket quotas
+	ObjectStoreUUID string
+	// ClusterID identifies the kubernetes cluster in the tags of the buckets it provisions
+	ClusterID string
+	// Quarantine enables the quarantineOnDelete BucketClass parameter and starts the reaper
+	// deleting quarantined buckets
+	Quarantine bool
+	// QuarantineGracePeriod is how long quarantined buckets are kept before they are deleted,
+	// DefaultQuarantineGracePeriod is used when it is 0
+	QuarantineGracePeriod time.Duration
+	// UsernameTemplate and DisplayNameTemplate are the Go templates naming the IAM user of a grant,
+	// DefaultUsernameTemplate and DefaultDisplayNameTemplate are used when they are empty
+	UsernameTemplate    string
+	DisplayNameTemplate string
+	// Region is returned in the credentials of grants on buckets without a region BucketClass parameter,
+	// DefaultRegion is used when it is empty
+	Region string
+	// ObjectStores are the object stores served besides the one configured through the
+	// NewDriver arguments, BucketClasses pick one through the objectStore parameter
+	ObjectStores *ObjectStoresConfig
+	// ObjectStoreName looks up the endpoint of the object store of the NewDriver arguments in Prism Central,
+	// ntnxEndpoint must then be empty
+	ObjectStoreName string
+	// ResolveS3CACert fetches the CA certificate of the object store found by ObjectStoreName from Prism Central
+	ResolveS3CACert bool
+	// EndpointScheme and EndpointPort build the endpoint of the object store found by ObjectStoreName,
+	// "https" and the port of the scheme are used when they are empty
+	EndpointScheme string
+	EndpointPort   int
+	// EndpointRefreshInterval is how often the endpoints of object stores configured by name are looked up again,
+	// DefaultEndpointRefreshInterval is used when it is 0
+	EndpointRefreshInterval time.Duration
+	// Bootstrap enables the bootstrap mode for the object store of the NewDriver arguments:
+	// it runs with the keys of a service user created through Prism Central, accessKey and secretKey are ignored
+	Bootstrap *BootstrapOptions
+	// KeyRotation enables the rotation of the access keys of the IAM users created by grants
+	KeyRotation *KeyRotationOptions
+	// PublishCABundle writes the CA bundle of the object store of each BucketAccess to a ConfigMap
+	// next to its Secret, named after the Secret with the CABundleConfigMapSuffix
+	PublishCABundle bool
+}
+
+// NewDriver builds the driver servers. The object store configured through the endpoint and
+// credentials arguments is served when ntnxEndpoint or opts.ObjectStoreName is set,
+// along with the object stores of opts.ObjectStores.
 func NewDriver(ctx context.Context, provisioner, ntnxEndpoint, accessKey, secretKey,
-	pcEndpoint, pcUsername, pcPassword, accountName, s3CaCert, pcCaCert string, s3Insecure, pcInsecure bool) (*IdentityServer, *ProvisionerServer, error) {
+	pcEndpoint, pcUsername, pcPassword, accountName, s3CaCert, pcCaCert string, s3Insecure, pcInsecure bool,
+	opts Options) (*IdentityServer, *ProvisionerServer, error) {
 
-	s3Client, err := s3client.NewS3Agent(accessKey, secretKey, ntnxEndpoint, s3CaCert, s3Insecure, true)
+	var stores []*objectStore
+	var bootstrapped *objectStore
+	var creds Credentials
+	if ntnxEndpoint != "" || opts.ObjectStoreName != "" {
+		if opts.Bootstrap != nil {
+			pc, err := ntnxIam.NewPCClient(pcEndpoint, pcUsername, pcPassword, pcCaCert, pcInsecure, nil)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to create Prism Central client: %w", err)
+			}
+			if creds, err = bootstrapCredentials(ctx, pc, opts.Bootstrap); err != nil {
+				return nil, nil, fmt.Errorf("failed to bootstrap service user credentials: %w", err)
+			}
+			accessKey, secretKey = creds.AccessKey, creds.SecretKey
+		}
+
+		store, err := newObjectStore(ctx, provisioner, objectStoreSettings{
+			ObjectStoreConfig: ObjectStoreConfig{
+				Endpoint:        ntnxEndpoint,
+				ObjectStoreName: opts.ObjectStoreName,
+				ResolveS3CACert: opts.ResolveS3CACert,
+				EndpointScheme:  opts.EndpointScheme,
+				EndpointPort:    opts.EndpointPort,
+				AccessKey:       accessKey,
+				SecretKey:       secretKey,
+				AccountName:     accountName,
+				S3CACert:        s3CaCert,
+				PCCACert:        pcCaCert,
+				S3Insecure:      s3Insecure,
+				PCInsecure:      pcInsecure,
+				ObjectStoreUUID: opts.ObjectStoreUUID,
+				Region:          opts.Region,
+			},
+			pcEndpoint: pcEndpoint,
+			pcUsername: pcUsername,
+			pcPassword: pcPassword,
+		}, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		stores = append(stores, store)
+		if opts.Bootstrap != nil {
+			bootstrapped = store
+		}
+	}
+
+	defaultStore := ""
+	if opts.ObjectStores != nil {
+		defaultStore = opts.ObjectStores.Default
+		for _, config := range opts.ObjectStores.ObjectStores {
+			pcEndpoint, pcUsername, pcPassword, err := ntnxIam.GetCredsFromPCSecret(config.PCSecret)
+			if err != nil {
+				return nil, nil, fmt.Errorf("object store %q: %w", config.Name, err)
+			}
+			store, err := newObjectStore(ctx, provisioner, objectStoreSettings{
+				ObjectStoreConfig: config,
+				pcEndpoint:        pcEndpoint,
+				pcUsername:        pcUsername,
+				pcPassword:        pcPassword,
+			}, opts)
+			if err != nil {
+				return nil, nil, fmt.Errorf("object store %q: %w", config.Name, err)
+			}
+			stores = append(stores, store)
+		}
+	}
+
+	objectStores, err := newObjectStoreRegistry(defaultStore, stores...)
 	if err != nil {
-		errMsg := fmt.Errorf("failed to create S3 client: %w", err)
-		klog.Fatalln(errMsg)
+		return nil, nil, err
 	}
 
-	ntnxIamClient, err := ntnxIam.New(ntnxEndpoint, accessKey, secretKey, pcEndpoint, pcUsername, pcPassword, accountName, pcCaCert, pcInsecure, nil)
+	naming, err := newUserNaming(opts.UsernameTemplate, opts.DisplayNameTemplate)
 	if err != nil {
-		errMsg := fmt.Errorf("failed to create IAM client: %w", err)
-		klog.Fatalln(errMsg)
+		return nil, nil, err
 	}
+
+	refreshInterval := opts.EndpointRefreshInterval
+	if refreshInterval == 0 {
+		refreshInterval = DefaultEndpointRefreshInterval
+	}
+	for _, store := range objectStores.all() {
+		if opts.Quarantine {
+			go store.quarantine.Run(ctx)
+		}
+		if store.objectStoreName != "" {
+			go store.runEndpointRefresh(ctx, refreshInterval)
+		}
+	}
+	// a key retired before a restart is still deleted when the rotation has been disabled since
+	if bootstrapped != nil && (opts.Bootstrap.RotationInterval > 0 || creds.RetiringKey != "") {
+		go bootstrapped.runKeyRotation(ctx, opts.Bootstrap, creds)
+	}
+
+	var clients *kube.Clients
+	if (opts.KeyRotation != nil && opts.KeyRotation.Interval > 0) || opts.PublishCABundle {
+		if clients, err = kube.NewInClusterClients(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if opts.PublishCABundle {
+		go newCABundlePublisher(provisioner, objectStores, clients).run(ctx)
+	}
+	if opts.KeyRotation != nil && opts.KeyRotation.Interval > 0 {
+		rotator, err := newKeyRotator(provisioner, objectStores, clients, *opts.KeyRotation)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to set up access key rotation: %w", err)
+		}
+		go rotator.run(ctx)
+		if opts.KeyRotation.StatusAddress != "" {
+			go rotator.serveStatus(ctx)
+		}
+	}
+
 	return &IdentityServer{
 			provisioner: provisioner,
 		}, &ProvisionerServer{
-			provisioner:   provisioner,
-			s3Client:      s3Client,
-			ntnxIamClient: ntnxIamClient,
+			provisioner:        provisioner,
+			objectStores:       objectStores,
+			lifecycleConfigDir: opts.LifecycleConfigDir,
+			clusterID:          opts.ClusterID,
+			quarantine:         opts.Quarantine,
+			naming:             naming,
 		}, nil
 }
@@ -0,0 +1,111 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	ntnxIam "github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/admin"
+	"github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/util/transport"
+	"k8s.io/klog/v2"
+)
+
+// DefaultEndpointRefreshInterval is how often the endpoint of an object store configured by name is looked up again
+const DefaultEndpointRefreshInterval = 5 * time.Minute
+
+// ResolveObjectStore looks up the object store with the given name in Prism Central
+// and returns it along with its S3 endpoint served with the given scheme and port
+func ResolveObjectStore(ctx context.Context, api *ntnxIam.API, name, scheme string, port int) (ntnxIam.ObjectStore, string, error) {
+	store, err := api.GetObjectStoreByName(ctx, name)
+	if err != nil {
+		return store, "", fmt.Errorf("failed to look up object store %q: %w", name, err)
+	}
+	endpoint, err := store.S3Endpoint(scheme, port)
+	if err != nil {
+		return store, "", fmt.Errorf("failed to resolve endpoint of object store %q: %w", name, err)
+	}
+	return store, endpoint, nil
+}
+
+// refreshEndpoint looks up the endpoint of the object store again and switches the clients to it
+// when it changed, such as after a scale-out of the object store. The CA certificate is fetched
+// again too when it comes from Prism Central, before the new endpoint is used.
+func (o *objectStore) refreshEndpoint(ctx context.Context) error {
+	store, endpoint, err := ResolveObjectStore(ctx, o.ntnxIamClient, o.objectStoreName, o.endpointScheme, o.endpointPort)
+	if err != nil {
+		return err
+	}
+	if o.resolveS3CACert {
+		if err := o.refreshCACert(ctx, store.UUID); err != nil {
+			return err
+		}
+	}
+	current := o.currentEndpoint()
+	if endpoint == current {
+		return nil
+	}
+	if err := o.s3Client.SetEndpoint(endpoint); err != nil {
+		return err
+	}
+	o.endpoint.Store(endpoint)
+	klog.InfoS("Object store endpoint changed", "objectStore", o.objectStoreName, "from", current, "to", endpoint)
+	return nil
+}
+
+// refreshCACert fetches the CA certificate of the object store from Prism Central and switches
+// the S3 client and the caBundle of new grants to it when it changed, such as after a certificate renewal
+func (o *objectStore) refreshCACert(ctx context.Context, uuid string) error {
+	caCert, err := o.ntnxIamClient.GetObjectStoreCACert(ctx, uuid)
+	if err != nil {
+		return fmt.Errorf("failed to fetch CA certificate of object store %q: %w", o.objectStoreName, err)
+	}
+	var caBundle []byte
+	if caCert != "" {
+		if caBundle, err = transport.DecodeCACert(caCert); err != nil {
+			return fmt.Errorf("invalid CA certificate of object store %q: %w", o.objectStoreName, err)
+		}
+	}
+	if bytes.Equal(caBundle, o.currentCABundle()) {
+		return nil
+	}
+	if err := o.s3Client.SetCACert(caCert); err != nil {
+		return err
+	}
+	o.s3CACert.Store(caBundle)
+	klog.InfoS("Object store CA certificate changed", "objectStore", o.objectStoreName)
+	return nil
+}
+
+// runEndpointRefresh refreshes the endpoint of the object store every interval until ctx is done
+func (o *objectStore) runEndpointRefresh(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := o.refreshEndpoint(ctx); err != nil {
+			klog.ErrorS(err, "failed to refresh object store endpoint", "objectStore", o.objectStoreName)
+		}
+	}
+}
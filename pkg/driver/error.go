@@ -1,8 +1,214 @@
 package driver
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	ntnxIam "github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/admin"
+	s3cli "github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/util/s3client"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
 
 var (
-	errNilProtocol       = errors.New("protocol is nil")
-	errs3ProtocolMissing = errors.New("S3 protocol not defined")
+	errNilProtocol        = errors.New("protocol is nil")
+	errs3ProtocolMissing  = errors.New("S3 protocol not defined")
+	errNoObjectStoreUUID  = errors.New("object store UUID not set")
+	errQuarantineDisabled = errors.New("quarantine not enabled")
+
+	// errUserNotOwned is returned when the IAM user of a grant exists but was not created by the driver for it
+	errUserNotOwned = errors.New("IAM user exists with another display name")
 )
+
+// Reasons of the ErrorInfo detail carrying the cause of a failed request
+const (
+	reasonObjectStoreError  = "OBJECT_STORE_ERROR"
+	reasonPrismCentralError = "PRISM_CENTRAL_ERROR"
+	reasonIAMUserError      = "IAM_USER_ERROR"
+	reasonDriverError       = "DRIVER_ERROR"
+)
+
+// s3ErrorCodes maps S3 error codes to the gRPC code reporting them
+var s3ErrorCodes = map[string]codes.Code{
+	"InvalidArgument":   codes.InvalidArgument,
+	"InvalidBucketName": codes.InvalidArgument,
+	"InvalidRequest":    codes.InvalidArgument,
+	"InvalidTag":        codes.InvalidArgument,
+	"MalformedPolicy":   codes.InvalidArgument,
+	"MalformedXML":      codes.InvalidArgument,
+
+	"BucketAlreadyExists":     codes.AlreadyExists,
+	"BucketAlreadyOwnedByYou": codes.AlreadyExists,
+
+	s3cli.ErrNoSuchBucket:       codes.NotFound,
+	s3cli.ErrNoSuchBucketPolicy: codes.NotFound,
+	s3cli.ErrNoSuchTagSet:       codes.NotFound,
+	"NoSuchKey":                 codes.NotFound,
+	"NoSuchUpload":              codes.NotFound,
+
+	s3cli.ErrBucketNotEmpty: codes.FailedPrecondition,
+
+	"AccessDenied":          codes.PermissionDenied,
+	"InvalidAccessKeyId":    codes.PermissionDenied,
+	"SignatureDoesNotMatch": codes.PermissionDenied,
+
+	"TooManyBuckets": codes.ResourceExhausted,
+	"QuotaExceeded":  codes.ResourceExhausted,
+
+	request.ErrCodeRequestError:    codes.Unavailable,
+	request.ErrCodeResponseTimeout: codes.Unavailable,
+	"RequestTimeout":               codes.Unavailable,
+	"SlowDown":                     codes.Unavailable,
+	"ServiceUnavailable":           codes.Unavailable,
+	"InternalError":                codes.Unavailable,
+	"Throttling":                   codes.Unavailable,
+}
+
+// isS3ErrorCode reports whether err is, or wraps, an S3 error with the given code
+func isS3ErrorCode(err error, code string) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == code
+}
+
+// isConflict reports whether Prism Central rejected a call with 409 Conflict, such as the creation
+// of a user that already exists
+func isConflict(err error) bool {
+	var userErr *ntnxIam.UserError
+	var httpErr *ntnxIam.HTTPError
+	return (errors.As(err, &userErr) && userErr.Code == http.StatusConflict) ||
+		(errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusConflict)
+}
+
+// errorCode returns the gRPC code reporting a failed call to the object store or Prism Central.
+// Failures worth retrying are Unavailable so that the sidecar retries the request,
+// errors the driver cannot classify are Internal.
+func errorCode(err error) codes.Code {
+	switch {
+	case errors.Is(err, s3cli.ErrBucketAlreadyExists), errors.Is(err, s3cli.ErrBucketAlreadyOwnedByYou):
+		return codes.AlreadyExists
+	case errors.Is(err, ntnxIam.ErrUserNotFound):
+		return codes.NotFound
+	case errors.Is(err, errUserNotOwned):
+		return codes.FailedPrecondition
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	}
+
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		if code, ok := s3ErrorCodes[aerr.Code()]; ok {
+			return code
+		}
+		var reqErr awserr.RequestFailure
+		if errors.As(err, &reqErr) {
+			return httpStatusCode(reqErr.StatusCode())
+		}
+	}
+
+	var userErr *ntnxIam.UserError
+	if errors.As(err, &userErr) {
+		return httpStatusCode(userErr.Code)
+	}
+
+	var httpErr *ntnxIam.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpStatusCode(httpErr.StatusCode)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return codes.Unavailable
+	}
+	return codes.Internal
+}
+
+// httpStatusCode maps the HTTP status of a failed Objects or Prism Central call to a gRPC code
+func httpStatusCode(statusCode int) codes.Code {
+	switch {
+	case statusCode == http.StatusBadRequest || statusCode == http.StatusUnprocessableEntity:
+		return codes.InvalidArgument
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return codes.PermissionDenied
+	case statusCode == http.StatusNotFound:
+		return codes.NotFound
+	case statusCode == http.StatusConflict:
+		return codes.AlreadyExists
+	case statusCode == http.StatusRequestEntityTooLarge || statusCode == http.StatusInsufficientStorage:
+		return codes.ResourceExhausted
+	case statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError:
+		return codes.Unavailable
+	}
+	return codes.Internal
+}
+
+// errorInfo describes the cause of a failed request, so that it is visible
+// to the caller without reading the driver logs
+func errorInfo(domain string, err error) *errdetails.ErrorInfo {
+	info := &errdetails.ErrorInfo{
+		Reason:   reasonDriverError,
+		Domain:   domain,
+		Metadata: map[string]string{"cause": err.Error()},
+	}
+
+	var aerr awserr.Error
+	var userErr *ntnxIam.UserError
+	var httpErr *ntnxIam.HTTPError
+	switch {
+	case errors.As(err, &aerr):
+		info.Reason = reasonObjectStoreError
+		info.Metadata["code"] = aerr.Code()
+		info.Metadata["message"] = aerr.Message()
+		var reqErr awserr.RequestFailure
+		if errors.As(err, &reqErr) {
+			info.Metadata["statusCode"] = strconv.Itoa(reqErr.StatusCode())
+		}
+	case errors.As(err, &userErr):
+		info.Reason = reasonIAMUserError
+		info.Metadata["code"] = strconv.Itoa(userErr.Code)
+		info.Metadata["message"] = userErr.Message
+	case errors.As(err, &httpErr):
+		info.Reason = reasonPrismCentralError
+		info.Metadata["statusCode"] = strconv.Itoa(httpErr.StatusCode)
+	}
+	return info
+}
+
+// errorSummary is the one line description of err appended to status messages
+func errorSummary(err error) string {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return aerr.Code() + ": " + aerr.Message()
+	}
+	return err.Error()
+}
+
+// toStatus translates err into the gRPC status of a failed request.
+// The message starts with msg, the cause is attached as an ErrorInfo detail of the given domain.
+func toStatus(domain string, err error, msg string) *status.Status {
+	st := status.New(errorCode(err), msg+": "+errorSummary(err))
+	detailed, detailErr := st.WithDetails(errorInfo(domain, err))
+	if detailErr != nil {
+		klog.ErrorS(detailErr, "failed to attach error details to status")
+		return st
+	}
+	return detailed
+}
+
+// withCode returns the gRPC status error err with its code replaced, its message and details are kept
+func withCode(err error, code codes.Code) error {
+	st := status.Convert(err).Proto()
+	st.Code = int32(code)
+	return status.FromProto(st).Err()
+}
+
+// statusError translates err into the gRPC status error of a failed request
+func (s *ProvisionerServer) statusError(err error, msg string) error {
+	return toStatus(s.provisioner, err, msg).Err()
+}
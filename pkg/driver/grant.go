@@ -0,0 +1,107 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"strings"
+
+	s3cli "github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/util/s3client"
+)
+
+// listSidSuffix is appended to the username for the listing statement of a prefix grant
+const listSidSuffix = "-list"
+
+// prefixListActions are the bucket actions of a prefix grant, limited to the prefix through s3:prefix
+var prefixListActions = map[s3cli.Action]bool{
+	s3cli.ListBucket:         true,
+	s3cli.ListBucketVersions: true,
+}
+
+// grantStatements builds the bucket policy statements sharing the bucket with userName.
+// A grant for the whole bucket is a single statement with the username as Sid.
+// A prefix grant allows the object actions below the prefix, and listing of the prefix
+// in a second statement, any other bucket action is left out.
+// The conditions of the BucketAccessClass apply to every statement.
+func grantStatements(userName, bucketName string, params *accessParameters) []s3cli.PolicyStatement {
+	if params.prefix == "" {
+		statement := s3cli.NewPolicyStatement().
+			WithSID(userName).
+			ForPrincipals(userName).
+			ForResources(bucketName).
+			ForSubResources(bucketName).
+			Allows().
+			Actions(params.actions...).
+			When(params.conditions...)
+		return []s3cli.PolicyStatement{*statement}
+	}
+
+	objectActions := []s3cli.Action{}
+	listActions := []s3cli.Action{}
+	for _, a := range params.actions {
+		switch {
+		case a == s3cli.All:
+			objectActions = append(objectActions, a)
+			listActions = append(listActions, s3cli.ListBucket, s3cli.ListBucketVersions)
+		case s3cli.IsObjectAction(a):
+			objectActions = append(objectActions, a)
+		case prefixListActions[a]:
+			listActions = append(listActions, a)
+		}
+	}
+
+	statements := []s3cli.PolicyStatement{}
+	if len(objectActions) > 0 {
+		statement := s3cli.NewPolicyStatement().
+			WithSID(userName).
+			ForPrincipals(userName).
+			ForSubResources(bucketName + "/" + strings.TrimSuffix(params.prefix, "/")).
+			Allows().
+			Actions(objectActions...).
+			When(params.conditions...)
+		statements = append(statements, *statement)
+	}
+	if len(listActions) > 0 {
+		statement := s3cli.NewPolicyStatement().
+			WithSID(userName + listSidSuffix).
+			ForPrincipals(userName).
+			ForResources(bucketName).
+			Allows().
+			Actions(listActions...).
+			When(s3cli.PrefixLike(params.prefix + "*")).
+			When(params.conditions...)
+		statements = append(statements, *statement)
+	}
+	return statements
+}
+
+// revokeStatements removes the access of userName from the bucket policy: the statements created by
+// grantStatements are dropped, and the user is ejected from any other statement naming it.
+func revokeStatements(policy *s3cli.BucketPolicy, userName string) *s3cli.BucketPolicy {
+	return policy.
+		DropPolicyStatements(userName, userName+listSidSuffix).
+		EjectPrincipals(userName)
+}
+
+// isGrantStatement reports whether a statement was written by grantStatements: it allows a single user,
+// whose username is its Sid. Statements written by anyone else are left alone by the driver.
+func isGrantStatement(stmt s3cli.PolicyStatement) bool {
+	users := stmt.Principals()
+	if !stmt.IsAllow() || len(stmt.Principal) != 1 || len(users) != 1 {
+		return false
+	}
+	return stmt.Sid == users[0] || stmt.Sid == users[0]+listSidSuffix
+}
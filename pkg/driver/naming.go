@@ -0,0 +1,157 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultUsernameTemplate names the IAM user of a grant after the BucketAccess, "ba-<BucketAccessUUID>@nutanix.com"
+	DefaultUsernameTemplate = "{{ .Name }}@nutanix.com"
+	// DefaultDisplayNameTemplate is the display name of the IAM user of a grant, "<accountName>_ba-<BucketAccessUUID>"
+	DefaultDisplayNameTemplate = "{{ .AccountName }}_{{ .Name }}"
+
+	// namingParameterPrefix is the BucketAccessClass parameter prefix for values used by the naming templates
+	namingParameterPrefix = "naming."
+
+	maxUsernameLength    = 255
+	maxDisplayNameLength = 255
+
+	// sampleName stands for the grant name when checking the username template at startup
+	sampleName = "ba-00000000-0000-0000-0000-000000000000"
+)
+
+// namingData holds the variables available to the naming templates
+type namingData struct {
+	// Name is the name of the grant request, "ba-<BucketAccessUUID>"
+	Name string
+	// AccountName is the account name the driver is configured with
+	AccountName string
+	// Parameters are the "naming.<key>" BucketAccessClass parameters, by key
+	Parameters map[string]string
+}
+
+// userNaming renders the username and display name of the IAM user created for a grant
+type userNaming struct {
+	username    *template.Template
+	displayName *template.Template
+}
+
+// newUserNaming parses the naming templates, empty templates fall back to the defaults.
+// Templates referencing a missing parameter fail to render instead of producing an empty value.
+// The username template must render .Name, the only variable unique to a grant, so that two
+// BucketAccesses never share an IAM user.
+func newUserNaming(usernameTemplate, displayNameTemplate string) (*userNaming, error) {
+	if usernameTemplate == "" {
+		usernameTemplate = DefaultUsernameTemplate
+	}
+	if displayNameTemplate == "" {
+		displayNameTemplate = DefaultDisplayNameTemplate
+	}
+
+	username, err := template.New("username").Option("missingkey=error").Parse(usernameTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid username template: %w", err)
+	}
+	if err := checkRendersName(username); err != nil {
+		return nil, err
+	}
+	displayName, err := template.New("displayName").Option("missingkey=error").Parse(displayNameTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid display name template: %w", err)
+	}
+	return &userNaming{
+		username:    username,
+		displayName: displayName,
+	}, nil
+}
+
+// names renders the username and display name for a grant and validates them against the IAM rules
+func (n *userNaming) names(data namingData) (username, displayName string, err error) {
+	if username, err = render(n.username, data); err != nil {
+		return "", "", err
+	}
+	if err := validateUsername(username); err != nil {
+		return "", "", err
+	}
+	// a template rendering .Name only under some parameters passes the startup check
+	if !strings.Contains(username, data.Name) {
+		return "", "", fmt.Errorf("username %q does not contain the grant name %q", username, data.Name)
+	}
+	if displayName, err = render(n.displayName, data); err != nil {
+		return "", "", err
+	}
+	if displayName == "" || utf8.RuneCountInString(displayName) > maxDisplayNameLength {
+		return "", "", fmt.Errorf("display name %q must be 1 to %d characters long", displayName, maxDisplayNameLength)
+	}
+	return username, displayName, nil
+}
+
+func render(t *template.Template, data namingData) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to render %s template: %w", t.Name(), err)
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// checkRendersName renders the username template with a sample grant name and no naming parameters,
+// missing parameters rendering empty, and fails when the sample name is not part of the result
+func checkRendersName(username *template.Template) error {
+	sample, err := username.Clone()
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	if err := sample.Option("missingkey=zero").Execute(&b, namingData{Name: sampleName}); err != nil {
+		return fmt.Errorf("invalid username template: %w", err)
+	}
+	if !strings.Contains(b.String(), sampleName) {
+		return fmt.Errorf("invalid username template: the username must contain {{ .Name }} to be unique to the grant")
+	}
+	return nil
+}
+
+// validateUsername checks the rules of Nutanix IAM usernames: users are external users
+// identified by a plain email address such as "user@example.com"
+func validateUsername(username string) error {
+	if username == "" || len(username) > maxUsernameLength {
+		return fmt.Errorf("username %q must be 1 to %d characters long", username, maxUsernameLength)
+	}
+	addr, err := mail.ParseAddress(username)
+	if err != nil || addr.Address != username || addr.Name != "" {
+		return fmt.Errorf("username %q must be an email address such as user@example.com", username)
+	}
+	return nil
+}
+
+// parseNamingParameter stores a "naming.<key>: <value>" BucketAccessClass parameter for the naming templates
+func parseNamingParameter(p *accessParameters, key, value string) error {
+	if key == "" {
+		return fmt.Errorf("naming parameter key must not be empty")
+	}
+	if p.naming == nil {
+		p.naming = map[string]string{}
+	}
+	p.naming[key] = value
+	return nil
+}
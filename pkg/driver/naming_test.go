@@ -0,0 +1,100 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"strings"
+	"testing"
+)
+
+var testGrant = namingData{
+	Name:        "ba-2c7f1b4e",
+	AccountName: "ntnx-cosi-iam-user",
+	Parameters:  map[string]string{"team": "analytics"},
+}
+
+func mustUserNaming(t *testing.T, usernameTemplate, displayNameTemplate string) *userNaming {
+	t.Helper()
+	n, err := newUserNaming(usernameTemplate, displayNameTemplate)
+	if err != nil {
+		t.Fatalf("newUserNaming(%q, %q) error = %v", usernameTemplate, displayNameTemplate, err)
+	}
+	return n
+}
+
+func TestUserNamingDefaults(t *testing.T) {
+	username, displayName, err := mustUserNaming(t, "", "").names(testGrant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "ba-2c7f1b4e@nutanix.com" || displayName != "ntnx-cosi-iam-user_ba-2c7f1b4e" {
+		t.Errorf("names() = %q, %q, want the default names", username, displayName)
+	}
+}
+
+func TestUserNamingParameters(t *testing.T) {
+	// surrounding whitespace of the rendered names is trimmed
+	n := mustUserNaming(t, " {{ .Parameters.team }}-{{ .Name }}@example.com\n", "{{ .Parameters.team }} {{ .Name }}")
+	username, displayName, err := n.names(testGrant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "analytics-ba-2c7f1b4e@example.com" || displayName != "analytics ba-2c7f1b4e" {
+		t.Errorf("names() = %q, %q", username, displayName)
+	}
+
+	if _, _, err := n.names(namingData{Name: "ba-1"}); err == nil {
+		t.Error("names() succeeded without the naming parameter of the template")
+	}
+}
+
+func TestUserNamingRejectsInvalidNames(t *testing.T) {
+	for _, n := range []*userNaming{
+		mustUserNaming(t, "{{ .Name }}", ""),
+		mustUserNaming(t, "User <{{ .Name }}@example.com>", ""),
+		mustUserNaming(t, strings.Repeat("a", maxUsernameLength)+"{{ .Name }}@example.com", ""),
+		// the username only renders the grant name without the parameter
+		mustUserNaming(t, "{{ if .Parameters.team }}shared{{ else }}{{ .Name }}{{ end }}@example.com", ""),
+		mustUserNaming(t, "", "{{ if false }}x{{ end }}"),
+		mustUserNaming(t, "", strings.Repeat("é", maxDisplayNameLength+1)),
+	} {
+		if username, displayName, err := n.names(testGrant); err == nil {
+			t.Errorf("names() = %q, %q, want an error", username, displayName)
+		}
+	}
+
+	// the display name length is counted in characters
+	if _, _, err := mustUserNaming(t, "", strings.Repeat("é", maxDisplayNameLength)).names(testGrant); err != nil {
+		t.Errorf("names() error = %v for a display name of %d characters", err, maxDisplayNameLength)
+	}
+}
+
+func TestNewUserNamingRejectsTemplates(t *testing.T) {
+	for _, templates := range [][2]string{
+		{"{{ .Name", ""},
+		{"", "{{ end }}"},
+		// usernames that would be shared by several grants
+		{"cosi@example.com", ""},
+		{"{{ .Parameters.team }}@example.com", ""},
+		{"{{ .AccountName }}@example.com", ""},
+		{"{{ if .Parameters.unique }}{{ .Name }}{{ end }}x@example.com", ""},
+	} {
+		if _, err := newUserNaming(templates[0], templates[1]); err == nil {
+			t.Errorf("newUserNaming(%q, %q) succeeded", templates[0], templates[1])
+		}
+	}
+}
@@ -0,0 +1,360 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	ntnxIam "github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/admin"
+	s3cli "github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/util/s3client"
+	"github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/util/transport"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	cosiapi "sigs.k8s.io/container-object-storage-interface-api/apis/objectstorage/v1alpha1"
+	cosiclient "sigs.k8s.io/container-object-storage-interface-api/client/clientset/versioned"
+)
+
+// bucketIDSeparator separates the object store name from the bucket name in the BucketId
+// of buckets on a named object store. Bucket names cannot contain it.
+const bucketIDSeparator = "/"
+
+// ObjectStoreConfig is a named object store profile of the object stores config file
+type ObjectStoreConfig struct {
+	// Name selects the object store through the objectStore BucketClass parameter
+	Name string `yaml:"name"`
+	// Endpoint is the Nutanix Object Store instance endpoint
+	Endpoint string `yaml:"endpoint"`
+	// ObjectStoreName looks up the endpoint of the object store in Prism Central instead of Endpoint
+	ObjectStoreName string `yaml:"objectStoreName"`
+	// ResolveS3CACert fetches the CA certificate of the object store found by ObjectStoreName
+	// from Prism Central when S3CACert is empty
+	ResolveS3CACert bool `yaml:"resolveS3CACert"`
+	// EndpointScheme and EndpointPort build the endpoint of the object store found by ObjectStoreName,
+	// "https" and the port of the scheme are used when they are empty
+	EndpointScheme string `yaml:"endpointScheme"`
+	EndpointPort   int    `yaml:"endpointPort"`
+	// AccessKey and SecretKey are the admin IAM keys of the object store
+	AccessKey string `yaml:"accessKey"`
+	SecretKey string `yaml:"secretKey"`
+	// PCSecret holds the Prism Central credentials as <prism-ip>:<prism-port>:<pc_user>:<pc_password>
+	PCSecret string `yaml:"pcSecret"`
+	// AccountName is the display name prefix of the IAM users
+	AccountName string `yaml:"accountName"`
+	// S3CACert and PCCACert are the CA certificates of the S3 and Prism Central endpoints, PEM or base64 PEM
+	S3CACert string `yaml:"s3CACert"`
+	PCCACert string `yaml:"pcCACert"`
+	// S3Insecure and PCInsecure disable the certificate validation of the endpoints
+	S3Insecure bool `yaml:"s3Insecure"`
+	PCInsecure bool `yaml:"pcInsecure"`
+	// ObjectStoreUUID identifies the object store in Prism Central, it is required for bucket quotas
+	ObjectStoreUUID string `yaml:"objectStoreUUID"`
+	// Region is returned in the credentials of grants, DefaultRegion is used when it is empty
+	Region string `yaml:"region"`
+}
+
+// ObjectStoresConfig is the object stores config file, it lists the object stores served by the driver
+// besides the one configured through the driver flags
+type ObjectStoresConfig struct {
+	// Default names the object store of BucketClasses without objectStore parameter.
+	// When empty the object store configured through the driver flags is used.
+	Default      string              `yaml:"default"`
+	ObjectStores []ObjectStoreConfig `yaml:"objectStores"`
+}
+
+// LoadObjectStoresConfig reads and validates the object stores config file at path
+func LoadObjectStoresConfig(path string) (*ObjectStoresConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object stores config: %w", err)
+	}
+	defer f.Close()
+
+	config := &ObjectStoresConfig{}
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("invalid object stores config %q: %w", path, err)
+	}
+
+	names := map[string]bool{}
+	for _, c := range config.ObjectStores {
+		if err := validateObjectStoreName(c.Name); err != nil {
+			return nil, fmt.Errorf("invalid object stores config %q: %w", path, err)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("invalid object stores config %q: object store %q is listed twice", path, c.Name)
+		}
+		names[c.Name] = true
+	}
+	if config.Default != "" && !names[config.Default] {
+		return nil, fmt.Errorf("invalid object stores config %q: default object store %q is not listed", path, config.Default)
+	}
+	return config, nil
+}
+
+// Get returns the profile of the named object store
+func (c *ObjectStoresConfig) Get(name string) (*ObjectStoreConfig, error) {
+	for i := range c.ObjectStores {
+		if c.ObjectStores[i].Name == name {
+			return &c.ObjectStores[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown object store %q", name)
+}
+
+// validateObjectStoreName accepts lowercase DNS labels, which keep BucketIds unambiguous
+func validateObjectStoreName(name string) error {
+	if name == "" || len(name) > 63 ||
+		strings.Trim(name, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" ||
+		strings.HasPrefix(name, "-") || strings.HasSuffix(name, "-") {
+		return fmt.Errorf("object store name %q must be a lowercase DNS label", name)
+	}
+	return nil
+}
+
+// objectStore holds the clients and settings of one Nutanix Object Store served by the driver
+type objectStore struct {
+	// name is "" for the object store configured through the driver flags
+	name          string
+	s3Client      *s3cli.S3Agent
+	ntnxIamClient *ntnxIam.API
+	// endpoint is the current S3 endpoint, it changes for object stores configured by objectStoreName
+	endpoint atomic.Value
+	// objectStoreName is the Prism Central name the endpoint is looked up with, "" for a fixed endpoint
+	objectStoreName string
+	// endpointScheme and endpointPort build the endpoint of an object store looked up by name
+	endpointScheme string
+	endpointPort   int
+	// resolveS3CACert is set when the CA certificate comes from Prism Central, it is refreshed with the endpoint
+	resolveS3CACert bool
+	// soft-deleted buckets waiting for the reaper
+	quarantine *Quarantine
+	// region returned in the credentials of grants on buckets created in the default location
+	region string
+	// s3CACert is the PEM encoded CA bundle of the S3 endpoint published to the apps in a ConfigMap,
+	// it changes for object stores whose CA certificate is fetched from Prism Central
+	s3CACert atomic.Value
+}
+
+// objectStoreSettings are the settings of an object store with the Prism Central credentials already split up
+type objectStoreSettings struct {
+	ObjectStoreConfig
+	pcEndpoint string
+	pcUsername string
+	pcPassword string
+}
+
+func newObjectStore(ctx context.Context, provisioner string, settings objectStoreSettings, opts Options) (*objectStore, error) {
+	resolveS3CACert := false
+	if settings.ObjectStoreName != "" {
+		if settings.Endpoint != "" {
+			return nil, fmt.Errorf("endpoint and object store name cannot both be set")
+		}
+		resolveS3CACert = settings.ResolveS3CACert && settings.S3CACert == "" && !settings.S3Insecure
+		if err := settings.resolve(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	s3Client, err := s3cli.NewS3Agent(settings.AccessKey, settings.SecretKey, settings.Endpoint, settings.S3CACert, settings.S3Insecure, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	ntnxIamClient, err := ntnxIam.New(settings.Endpoint, settings.AccessKey, settings.SecretKey,
+		settings.pcEndpoint, settings.pcUsername, settings.pcPassword, settings.AccountName,
+		settings.PCCACert, settings.PCInsecure, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create IAM client: %w", err)
+	}
+	ntnxIamClient.ObjectStoreUUID = settings.ObjectStoreUUID
+
+	region := settings.Region
+	if region == "" {
+		region = DefaultRegion
+	}
+
+	// the CA certificate is published to the apps of the grants
+	var caBundle []byte
+	if settings.S3CACert != "" {
+		if caBundle, err = transport.DecodeCACert(settings.S3CACert); err != nil {
+			return nil, fmt.Errorf("invalid S3 CA certificate: %w", err)
+		}
+	}
+
+	gracePeriod := opts.QuarantineGracePeriod
+	if gracePeriod == 0 {
+		gracePeriod = DefaultQuarantineGracePeriod
+	}
+
+	store := &objectStore{
+		name:            settings.Name,
+		s3Client:        s3Client,
+		ntnxIamClient:   ntnxIamClient,
+		objectStoreName: settings.ObjectStoreName,
+		endpointScheme:  settings.EndpointScheme,
+		endpointPort:    settings.EndpointPort,
+		resolveS3CACert: resolveS3CACert,
+		quarantine:      NewQuarantine(s3Client, provisioner, gracePeriod),
+		region:          region,
+	}
+	store.endpoint.Store(settings.Endpoint)
+	store.s3CACert.Store(caBundle)
+	return store, nil
+}
+
+// resolve fills the endpoint, and optionally the object store UUID and CA certificate,
+// from the object store found by name in Prism Central
+func (settings *objectStoreSettings) resolve(ctx context.Context) error {
+	pc, err := ntnxIam.NewPCClient(settings.pcEndpoint, settings.pcUsername, settings.pcPassword, settings.PCCACert, settings.PCInsecure, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create Prism Central client: %w", err)
+	}
+	store, endpoint, err := ResolveObjectStore(ctx, pc, settings.ObjectStoreName, settings.EndpointScheme, settings.EndpointPort)
+	if err != nil {
+		return err
+	}
+	klog.InfoS("Resolved object store endpoint", "objectStore", settings.ObjectStoreName, "uuid", store.UUID, "endpoint", endpoint)
+	settings.Endpoint = endpoint
+	if settings.ObjectStoreUUID == "" {
+		settings.ObjectStoreUUID = store.UUID
+	}
+
+	if settings.ResolveS3CACert && settings.S3CACert == "" && !settings.S3Insecure {
+		caCert, err := pc.GetObjectStoreCACert(ctx, store.UUID)
+		if err != nil {
+			return fmt.Errorf("failed to fetch CA certificate of object store %q: %w", settings.ObjectStoreName, err)
+		}
+		settings.S3CACert = caCert
+	}
+	return nil
+}
+
+// currentEndpoint returns the S3 endpoint the object store is reached at
+func (o *objectStore) currentEndpoint() string {
+	return o.endpoint.Load().(string)
+}
+
+// currentCABundle returns the PEM encoded CA bundle of the S3 endpoint, nil when none is configured
+func (o *objectStore) currentCABundle() []byte {
+	return o.s3CACert.Load().([]byte)
+}
+
+// bucketID returns the BucketId of a bucket, which records the object store holding it.
+// Buckets of the object store configured through the driver flags keep their plain name.
+func (o *objectStore) bucketID(bucketName string) string {
+	if o.name == "" {
+		return bucketName
+	}
+	return o.name + bucketIDSeparator + bucketName
+}
+
+// objectStoreRegistry holds the object stores served by the driver, by name
+type objectStoreRegistry struct {
+	stores map[string]*objectStore
+	// defaultName is the object store of BucketClasses without objectStore parameter
+	defaultName string
+}
+
+func newObjectStoreRegistry(defaultName string, stores ...*objectStore) (*objectStoreRegistry, error) {
+	r := &objectStoreRegistry{
+		stores:      map[string]*objectStore{},
+		defaultName: defaultName,
+	}
+	for _, o := range stores {
+		r.stores[o.name] = o
+	}
+	if len(r.stores) == 0 {
+		return nil, fmt.Errorf("no object store configured")
+	}
+	if _, ok := r.stores[defaultName]; !ok && defaultName != "" {
+		return nil, fmt.Errorf("default object store %q is not configured", defaultName)
+	}
+	return r, nil
+}
+
+// forParameter returns the object store selected by the objectStore BucketClass parameter,
+// "" selects the default object store
+func (r *objectStoreRegistry) forParameter(name string) (*objectStore, error) {
+	if name == "" {
+		name = r.defaultName
+	}
+	o, ok := r.stores[name]
+	if !ok {
+		if name == "" {
+			return nil, status.Error(codes.InvalidArgument, "no default object store is configured, set the objectStore BucketClass parameter")
+		}
+		return nil, status.Errorf(codes.InvalidArgument, "unknown object store %q", name)
+	}
+	return o, nil
+}
+
+// forBucketID returns the object store and the name of the bucket identified by a BucketId.
+// BucketIds without object store name were created by the object store configured through the
+// driver flags, or by the default object store when the driver has no such object store.
+func (r *objectStoreRegistry) forBucketID(bucketID string) (*objectStore, string, error) {
+	name, bucketName, found := strings.Cut(bucketID, bucketIDSeparator)
+	if !found {
+		bucketName, name = bucketID, ""
+		if _, ok := r.stores[""]; !ok {
+			name = r.defaultName
+		}
+	}
+	o, ok := r.stores[name]
+	if !ok {
+		return nil, "", status.Errorf(codes.FailedPrecondition, "bucket %q belongs to object store %q, which is not configured", bucketID, name)
+	}
+	return o, bucketName, nil
+}
+
+// forBucketAccess returns the object store of the bucket of a BucketAccess, found through the BucketId
+// of the Bucket of its BucketClaim
+func (r *objectStoreRegistry) forBucketAccess(ctx context.Context, client cosiclient.Interface, ba *cosiapi.BucketAccess) (*objectStore, error) {
+	claim, err := client.ObjectstorageV1alpha1().BucketClaims(ba.Namespace).Get(ctx, ba.Spec.BucketClaimName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get BucketClaim %q: %w", ba.Spec.BucketClaimName, err)
+	}
+	if claim.Status.BucketName == "" {
+		return nil, errors.New("the BucketClaim has no bucket yet")
+	}
+	bucket, err := client.ObjectstorageV1alpha1().Buckets().Get(ctx, claim.Status.BucketName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Bucket %q: %w", claim.Status.BucketName, err)
+	}
+	if bucket.Status.BucketID == "" {
+		return nil, fmt.Errorf("the Bucket %q is not provisioned yet", bucket.Name)
+	}
+	store, _, err := r.forBucketID(bucket.Status.BucketID)
+	return store, err
+}
+
+// all returns every object store
+func (r *objectStoreRegistry) all() []*objectStore {
+	stores := make([]*objectStore, 0, len(r.stores))
+	for _, o := range r.stores {
+		stores = append(stores, o)
+	}
+	return stores
+}
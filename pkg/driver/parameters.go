@@ -0,0 +1,557 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	s3cli "github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/util/s3client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// bucketParameters is the typed form of the BucketClass parameters
+// passed to DriverCreateBucket.
+type bucketParameters struct {
+	// versioning is the S3 versioning state to apply, "" leaves it untouched
+	versioning string
+	// objectLock is the default retention mode of an object lock enabled bucket,
+	// "" creates the bucket without object lock
+	objectLock string
+	// retentionDays is the default retention period applied with objectLock
+	retentionDays int64
+	// lifecycle is the driver managed lifecycle rule, either set inline
+	// or loaded from the document named by lifecycleConfigRef
+	lifecycle s3cli.LifecycleRules
+	// lifecycleConfigRef names a lifecycle document in the driver's lifecycle config directory
+	lifecycleConfigRef string
+	// quotaBytes is the hard quota set on the bucket through Prism Central, 0 means no quota
+	quotaBytes int64
+	// tags are the user defined bucket tags from the "tags.*" parameters
+	tags map[string]string
+	// adoptExisting lets the driver take over a bucket that already exists in the admin account
+	adoptExisting bool
+	// tagAdopted records the ownership of adopted buckets in their tags
+	tagAdopted bool
+	// purgeOnDelete empties the bucket before DriverDeleteBucket removes it
+	purgeOnDelete bool
+	// quarantineOnDelete soft-deletes the bucket, the quarantine reaper removes it after the grace period
+	quarantineOnDelete bool
+	// region is the location the bucket is created in, "" creates it in the default location of the object store
+	region string
+	// objectStore names the object store holding the bucket, "" is the default object store
+	objectStore string
+}
+
+// bucketParameter parses the value of a single BucketClass parameter into p
+type bucketParameter func(p *bucketParameters, value string) error
+
+// bucketParameterSchema lists every BucketClass parameter understood by the driver.
+// Bucket features register their parameters here.
+var bucketParameterSchema = map[string]bucketParameter{
+	"versioning":    parseVersioning,
+	"objectLock":    parseObjectLock,
+	"retentionDays": parseRetentionDays,
+
+	"expirationDays": func(p *bucketParameters, value string) error {
+		return parsePositiveIntInto(&p.lifecycle.ExpirationDays, value)
+	},
+	"noncurrentVersionExpirationDays": func(p *bucketParameters, value string) error {
+		return parsePositiveIntInto(&p.lifecycle.NoncurrentVersionExpirationDays, value)
+	},
+	"abortIncompleteMultipartUploadDays": func(p *bucketParameters, value string) error {
+		return parsePositiveIntInto(&p.lifecycle.AbortIncompleteMultipartUploadDays, value)
+	},
+	"lifecycleConfigRef": parseLifecycleConfigRef,
+
+	"quotaGiB": parseQuotaGiB,
+
+	"adoptExisting": func(p *bucketParameters, value string) error {
+		return parseBoolInto(&p.adoptExisting, value)
+	},
+	"tagAdopted": func(p *bucketParameters, value string) error {
+		return parseBoolInto(&p.tagAdopted, value)
+	},
+
+	"purgeOnDelete": func(p *bucketParameters, value string) error {
+		return parseBoolInto(&p.purgeOnDelete, value)
+	},
+	"quarantineOnDelete": func(p *bucketParameters, value string) error {
+		return parseBoolInto(&p.quarantineOnDelete, value)
+	},
+
+	"region": parseRegion,
+
+	"objectStore": func(p *bucketParameters, value string) error {
+		if err := validateObjectStoreName(value); err != nil {
+			return err
+		}
+		p.objectStore = value
+		return nil
+	},
+}
+
+// parseVersioning accepts the S3 versioning states "Enabled" and "Suspended"
+func parseVersioning(p *bucketParameters, value string) error {
+	switch value {
+	case s3.BucketVersioningStatusEnabled, s3.BucketVersioningStatusSuspended:
+		p.versioning = value
+		return nil
+	}
+	return fmt.Errorf("must be one of %q or %q", s3.BucketVersioningStatusEnabled, s3.BucketVersioningStatusSuspended)
+}
+
+// parseObjectLock accepts the retention modes "governance" and "compliance" in any case
+func parseObjectLock(p *bucketParameters, value string) error {
+	mode := strings.ToUpper(value)
+	switch mode {
+	case s3.ObjectLockRetentionModeGovernance, s3.ObjectLockRetentionModeCompliance:
+		p.objectLock = mode
+		return nil
+	}
+	return fmt.Errorf("must be one of %q or %q", "governance", "compliance")
+}
+
+func parseRetentionDays(p *bucketParameters, value string) error {
+	return parsePositiveIntInto(&p.retentionDays, value)
+}
+
+// parseLifecycleConfigRef accepts the plain file name of a lifecycle document
+func parseLifecycleConfigRef(p *bucketParameters, value string) error {
+	if value == "" || value == "." || value == ".." || filepath.Base(value) != value {
+		return fmt.Errorf("must be the name of a document in the lifecycle config directory")
+	}
+	p.lifecycleConfigRef = value
+	return nil
+}
+
+// maxRegionLength bounds region names, which are sent as the location constraint of new buckets
+const maxRegionLength = 64
+
+// parseRegion accepts region names such as "us-east-1"
+func parseRegion(p *bucketParameters, value string) error {
+	if value == "" || len(value) > maxRegionLength || strings.Trim(value, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+		return fmt.Errorf("must be 1 to %d lowercase letters, digits or dashes", maxRegionLength)
+	}
+	p.region = value
+	return nil
+}
+
+// gib is the number of bytes in a GiB
+const gib = 1 << 30
+
+func parseQuotaGiB(p *bucketParameters, value string) error {
+	quota, err := parsePositiveInt(value)
+	if err != nil {
+		return err
+	}
+	if quota > math.MaxInt64/gib {
+		return fmt.Errorf("must not exceed %d", math.MaxInt64/gib)
+	}
+	p.quotaBytes = quota * gib
+	return nil
+}
+
+// parseBoolInto parses "true" or "false" into dst
+func parseBoolInto(dst *bool, value string) error {
+	switch value {
+	case "true":
+		*dst = true
+	case "false":
+		*dst = false
+	default:
+		return fmt.Errorf("must be %q or %q", "true", "false")
+	}
+	return nil
+}
+
+// parsePositiveIntInto parses a strictly positive integer into dst
+func parsePositiveIntInto(dst *int64, value string) error {
+	n, err := parsePositiveInt(value)
+	if err != nil {
+		return err
+	}
+	*dst = n
+	return nil
+}
+
+// parsePositiveInt parses a strictly positive integer
+func parsePositiveInt(value string) (int64, error) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("must be a positive integer")
+	}
+	return n, nil
+}
+
+// bucketParameterPrefix parses a BucketClass parameter whose key starts with a known prefix,
+// key is the remainder of the parameter key after the prefix
+type bucketParameterPrefix func(p *bucketParameters, key, value string) error
+
+// bucketParameterPrefixSchema lists the BucketClass parameter prefixes understood by the driver
+var bucketParameterPrefixSchema = map[string]bucketParameterPrefix{
+	tagParameterPrefix: parseTag,
+}
+
+// parseBucketParameters validates the BucketClass parameters against bucketParameterSchema.
+// Unknown keys and invalid values are rejected with codes.InvalidArgument.
+func parseBucketParameters(params map[string]string) (*bucketParameters, error) {
+	return parseBucketParametersWith(params, true)
+}
+
+// parseBucketDeleteContext parses the BucketClass parameters handed back to DriverDeleteBucket.
+// Unknown keys are skipped so that buckets created by older driver versions can still be deleted.
+func parseBucketDeleteContext(params map[string]string) (*bucketParameters, error) {
+	return parseBucketParametersWith(params, false)
+}
+
+func parseBucketParametersWith(params map[string]string, strict bool) (*bucketParameters, error) {
+	p := &bucketParameters{
+		tagAdopted: true,
+	}
+
+	// Walk the keys in order so that errors are reported deterministically
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !strict && !isBucketParameter(key) {
+			continue
+		}
+		if err := parseBucketParameter(p, key, params[key]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.validate(); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid BucketClass parameters: %v", err)
+	}
+	return p, nil
+}
+
+// isBucketParameter reports whether key is described by the BucketClass parameter schema
+func isBucketParameter(key string) bool {
+	if _, ok := bucketParameterSchema[key]; ok {
+		return true
+	}
+	for prefix := range bucketParameterPrefixSchema {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseBucketParameter(p *bucketParameters, key, value string) error {
+	if parse, ok := bucketParameterSchema[key]; ok {
+		if err := parse(p, value); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid value %q for BucketClass parameter %q: %v", value, key, err)
+		}
+		return nil
+	}
+	for prefix, parse := range bucketParameterPrefixSchema {
+		if strings.HasPrefix(key, prefix) {
+			if err := parse(p, strings.TrimPrefix(key, prefix), value); err != nil {
+				return status.Errorf(codes.InvalidArgument, "invalid BucketClass parameter %q: %v", key, err)
+			}
+			return nil
+		}
+	}
+	return status.Errorf(codes.InvalidArgument, "unknown BucketClass parameter %q", key)
+}
+
+// validate checks the constraints between BucketClass parameters
+func (p *bucketParameters) validate() error {
+	if p.retentionDays != 0 && p.objectLock == "" {
+		return fmt.Errorf("retentionDays requires objectLock to be set")
+	}
+	if p.objectLock != "" && p.retentionDays == 0 {
+		return fmt.Errorf("objectLock requires retentionDays to be set")
+	}
+	// object lock keeps versioning enabled on the bucket, it can never be suspended
+	if p.objectLock != "" && p.versioning == s3.BucketVersioningStatusSuspended {
+		return fmt.Errorf("versioning cannot be %s on an objectLock bucket", s3.BucketVersioningStatusSuspended)
+	}
+	if p.lifecycleConfigRef != "" && !p.lifecycle.IsEmpty() {
+		return fmt.Errorf("lifecycleConfigRef cannot be combined with inline lifecycle parameters")
+	}
+	if !p.tagAdopted && !p.adoptExisting {
+		return fmt.Errorf("tagAdopted can only be disabled together with adoptExisting")
+	}
+	// leave room for the tags set by the driver
+	if len(p.tags) > maxTags-driverTagCount {
+		return fmt.Errorf("at most %d tags.* parameters are allowed", maxTags-driverTagCount)
+	}
+	return nil
+}
+
+// resolveLifecycleConfig loads the lifecycle document referenced by lifecycleConfigRef from dir.
+// Documents are JSON or YAML objects using the inline lifecycle parameter names as keys.
+func (p *bucketParameters) resolveLifecycleConfig(dir string) error {
+	if p.lifecycleConfigRef == "" {
+		return nil
+	}
+	if dir == "" {
+		return status.Error(codes.InvalidArgument, "lifecycleConfigRef is set but no lifecycle config directory is configured for the driver")
+	}
+
+	f, err := os.Open(filepath.Join(dir, p.lifecycleConfigRef))
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "failed to read lifecycle document %q: %v", p.lifecycleConfigRef, err)
+	}
+	defer f.Close()
+
+	// YAML is a superset of JSON so both formats are decoded here
+	var rules s3cli.LifecycleRules
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&rules); err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid lifecycle document %q: %v", p.lifecycleConfigRef, err)
+	}
+	if rules.ExpirationDays < 0 || rules.NoncurrentVersionExpirationDays < 0 || rules.AbortIncompleteMultipartUploadDays < 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid lifecycle document %q: days must be positive integers", p.lifecycleConfigRef)
+	}
+	if rules.IsEmpty() {
+		return status.Errorf(codes.InvalidArgument, "invalid lifecycle document %q: no lifecycle action set", p.lifecycleConfigRef)
+	}
+	p.lifecycle = rules
+	return nil
+}
+
+// accessParameters is the typed form of the BucketAccessClass parameters
+// passed to DriverGrantBucketAccess.
+type accessParameters struct {
+	// actions granted to the user on the bucket
+	actions []s3cli.Action
+	// prefix limits the grant to the objects below this key prefix, "" grants the whole bucket.
+	// It always ends with "/"
+	prefix string
+	// conditions restrict when the grant applies, such as the source network of the requests
+	conditions []s3cli.Condition
+	// naming holds the values of the "naming.<key>" parameters, by key, for the naming templates
+	naming map[string]string
+	// keyRotation lets the driver rotate the access keys of the grants of the class, when the rotation is enabled.
+	// It is off by default since the driver then rewrites the BucketAccess Secret owned by the COSI sidecar.
+	keyRotation bool
+}
+
+// accessParameter parses the value of a single BucketAccessClass parameter into p
+type accessParameter func(p *accessParameters, value string) error
+
+// accessParameterSchema lists every BucketAccessClass parameter understood by the driver.
+var accessParameterSchema = map[string]accessParameter{
+	"profile": parseProfile,
+	"actions": parseActions,
+	"prefix":  parsePrefix,
+
+	"allowedCIDRs": func(p *accessParameters, value string) error {
+		cidrs, err := parseCIDRs(value)
+		if err != nil {
+			return err
+		}
+		p.conditions = append(p.conditions, s3cli.SourceIPIn(cidrs...))
+		return nil
+	},
+	"deniedCIDRs": func(p *accessParameters, value string) error {
+		cidrs, err := parseCIDRs(value)
+		if err != nil {
+			return err
+		}
+		p.conditions = append(p.conditions, s3cli.SourceIPNotIn(cidrs...))
+		return nil
+	},
+	"requireTLS": func(p *accessParameters, value string) error {
+		var requireTLS bool
+		if err := parseBoolInto(&requireTLS, value); err != nil {
+			return err
+		}
+		if requireTLS {
+			p.conditions = append(p.conditions, s3cli.SecureTransport())
+		}
+		return nil
+	},
+	"keyRotation": func(p *accessParameters, value string) error {
+		return parseBoolInto(&p.keyRotation, value)
+	},
+	"validUntil": func(p *accessParameters, value string) error {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return fmt.Errorf("must be an RFC 3339 timestamp such as 2030-01-01T00:00:00Z")
+		}
+		p.conditions = append(p.conditions, s3cli.CurrentTimeBefore(t))
+		return nil
+	},
+}
+
+// accessParameterPrefix parses a BucketAccessClass parameter whose key starts with a known prefix,
+// key is the remainder of the parameter key after the prefix
+type accessParameterPrefix func(p *accessParameters, key, value string) error
+
+// accessParameterPrefixSchema lists the BucketAccessClass parameter prefixes understood by the driver
+var accessParameterPrefixSchema = map[string]accessParameterPrefix{
+	namingParameterPrefix: parseNamingParameter,
+}
+
+// permissionProfiles maps the names accepted by the profile parameter to the granted actions
+var permissionProfiles = map[string][]s3cli.Action{
+	"read-only":  s3cli.ReadOnlyActions,
+	"write-only": s3cli.WriteOnlyActions,
+	"read-write": s3cli.ReadWriteActions,
+	"admin":      s3cli.AdminActions,
+}
+
+// parseAccessParameters validates the BucketAccessClass parameters against accessParameterSchema.
+// Unknown keys and invalid values are rejected with codes.InvalidArgument.
+// Without profile or actions the user is granted s3cli.AllowedActions.
+func parseAccessParameters(params map[string]string) (*accessParameters, error) {
+	p := &accessParameters{}
+
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := parseAccessParameter(p, key, params[key]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.validate(params); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid BucketAccessClass parameters: %v", err)
+	}
+	if len(p.actions) == 0 {
+		p.actions = s3cli.AllowedActions
+		if p.prefix != "" {
+			// the default actions include bucket wide configuration which cannot be scoped to a prefix
+			p.actions = s3cli.ReadWriteActions
+		}
+	}
+	return p, nil
+}
+
+func parseAccessParameter(p *accessParameters, key, value string) error {
+	if parse, ok := accessParameterSchema[key]; ok {
+		if err := parse(p, value); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid value %q for BucketAccessClass parameter %q: %v", value, key, err)
+		}
+		return nil
+	}
+	for prefix, parse := range accessParameterPrefixSchema {
+		if strings.HasPrefix(key, prefix) {
+			if err := parse(p, strings.TrimPrefix(key, prefix), value); err != nil {
+				return status.Errorf(codes.InvalidArgument, "invalid BucketAccessClass parameter %q: %v", key, err)
+			}
+			return nil
+		}
+	}
+	return status.Errorf(codes.InvalidArgument, "unknown BucketAccessClass parameter %q", key)
+}
+
+// validate checks the constraints between BucketAccessClass parameters
+func (p *accessParameters) validate(params map[string]string) error {
+	_, hasProfile := params["profile"]
+	_, hasActions := params["actions"]
+	if hasProfile && hasActions {
+		return fmt.Errorf("profile and actions cannot be combined")
+	}
+	// explicitly listed bucket actions must be honoured, profiles are narrowed down by prefixGrant
+	if p.prefix != "" && hasActions {
+		for _, a := range p.actions {
+			if !s3cli.IsObjectAction(a) && !prefixListActions[a] {
+				return fmt.Errorf("action %q applies to the whole bucket and cannot be scoped to a prefix", a)
+			}
+		}
+	}
+	return nil
+}
+
+func parseProfile(p *accessParameters, value string) error {
+	actions, ok := permissionProfiles[value]
+	if !ok {
+		names := make([]string, 0, len(permissionProfiles))
+		for name := range permissionProfiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("must be one of %s", strings.Join(names, ", "))
+	}
+	p.actions = actions
+	return nil
+}
+
+// parsePrefix accepts a key prefix such as "team-a/", a missing trailing "/" is added
+func parsePrefix(p *accessParameters, value string) error {
+	prefix := strings.TrimSuffix(value, "/")
+	if prefix == "" || strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, "*?") {
+		return fmt.Errorf("must be a key prefix without wildcards or leading \"/\"")
+	}
+	p.prefix = prefix + "/"
+	return nil
+}
+
+// parseCIDRs accepts a comma separated list of CIDRs or IP addresses, IP addresses are turned into single host CIDRs
+func parseCIDRs(value string) ([]string, error) {
+	cidrs := []string{}
+	for _, c := range strings.Split(value, ",") {
+		c = strings.TrimSpace(c)
+		if ip := net.ParseIP(c); ip != nil {
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			c = fmt.Sprintf("%s/%d", ip, bits)
+		}
+		if _, _, err := net.ParseCIDR(c); err != nil {
+			return nil, fmt.Errorf("%q is not a CIDR or IP address", c)
+		}
+		cidrs = append(cidrs, c)
+	}
+	return cidrs, nil
+}
+
+// parseActions accepts a comma separated list of S3 actions such as "s3:GetObject,s3:ListBucket"
+func parseActions(p *accessParameters, value string) error {
+	seen := map[s3cli.Action]bool{}
+	actions := []s3cli.Action{}
+	for _, name := range strings.Split(value, ",") {
+		a, err := s3cli.ParseAction(strings.TrimSpace(name))
+		if err != nil {
+			return err
+		}
+		if !seen[a] {
+			seen[a] = true
+			actions = append(actions, a)
+		}
+	}
+	p.actions = actions
+	return nil
+}
@@ -0,0 +1,309 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	s3cli "github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/util/s3client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseBucketParameters(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  map[string]string
+		want    *bucketParameters
+		wantErr bool
+	}{
+		{
+			name:   "no parameters",
+			params: nil,
+			want:   &bucketParameters{tagAdopted: true},
+		},
+		{
+			name: "every parameter",
+			params: map[string]string{
+				"versioning":                         "Enabled",
+				"objectLock":                         "governance",
+				"retentionDays":                      "30",
+				"expirationDays":                     "90",
+				"noncurrentVersionExpirationDays":    "7",
+				"abortIncompleteMultipartUploadDays": "1",
+				"quotaGiB":                           "2",
+				"adoptExisting":                      "true",
+				"tagAdopted":                         "false",
+				"purgeOnDelete":                      "true",
+				"quarantineOnDelete":                 "true",
+				"region":                             "eu-west-1",
+				"objectStore":                        "store-b",
+				"tags.team":                          "a",
+			},
+			want: &bucketParameters{
+				versioning:    "Enabled",
+				objectLock:    "GOVERNANCE",
+				retentionDays: 30,
+				lifecycle: s3cli.LifecycleRules{
+					ExpirationDays:                     90,
+					NoncurrentVersionExpirationDays:    7,
+					AbortIncompleteMultipartUploadDays: 1,
+				},
+				quotaBytes:         2 << 30,
+				tags:               map[string]string{"team": "a"},
+				adoptExisting:      true,
+				purgeOnDelete:      true,
+				quarantineOnDelete: true,
+				region:             "eu-west-1",
+				objectStore:        "store-b",
+			},
+		},
+		{
+			name:   "compliance mode in any case",
+			params: map[string]string{"objectLock": "Compliance", "retentionDays": "1"},
+			want:   &bucketParameters{objectLock: "COMPLIANCE", retentionDays: 1, tagAdopted: true},
+		},
+		{
+			name:   "lifecycle document",
+			params: map[string]string{"lifecycleConfigRef": "short-lived.yaml"},
+			want:   &bucketParameters{lifecycleConfigRef: "short-lived.yaml", tagAdopted: true},
+		},
+		{name: "unknown parameter", params: map[string]string{"versionning": "Enabled"}, wantErr: true},
+		{name: "invalid versioning", params: map[string]string{"versioning": "enabled"}, wantErr: true},
+		{name: "invalid object lock mode", params: map[string]string{"objectLock": "legal-hold", "retentionDays": "1"}, wantErr: true},
+		{name: "retention without object lock", params: map[string]string{"retentionDays": "1"}, wantErr: true},
+		{name: "object lock without retention", params: map[string]string{"objectLock": "governance"}, wantErr: true},
+		{name: "suspended versioning with object lock", params: map[string]string{"objectLock": "governance", "retentionDays": "1", "versioning": "Suspended"}, wantErr: true},
+		{name: "zero days", params: map[string]string{"expirationDays": "0"}, wantErr: true},
+		{name: "negative days", params: map[string]string{"expirationDays": "-1"}, wantErr: true},
+		{name: "days not a number", params: map[string]string{"expirationDays": "1d"}, wantErr: true},
+		{name: "lifecycle document with inline rules", params: map[string]string{"lifecycleConfigRef": "a.yaml", "expirationDays": "1"}, wantErr: true},
+		{name: "lifecycle document outside the directory", params: map[string]string{"lifecycleConfigRef": "../a.yaml"}, wantErr: true},
+		{name: "lifecycle document parent directory", params: map[string]string{"lifecycleConfigRef": ".."}, wantErr: true},
+		{name: "quota overflow", params: map[string]string{"quotaGiB": "9223372036854775807"}, wantErr: true},
+		{name: "invalid bool", params: map[string]string{"purgeOnDelete": "yes"}, wantErr: true},
+		{name: "tagAdopted disabled without adoptExisting", params: map[string]string{"tagAdopted": "false"}, wantErr: true},
+		{name: "uppercase region", params: map[string]string{"region": "US-EAST-1"}, wantErr: true},
+		{name: "empty region", params: map[string]string{"region": ""}, wantErr: true},
+		{name: "invalid object store name", params: map[string]string{"objectStore": "Store_B"}, wantErr: true},
+		{name: "empty tag key", params: map[string]string{"tags.": "a"}, wantErr: true},
+		{name: "reserved tag key", params: map[string]string{"tags.aws:team": "a"}, wantErr: true},
+		{name: "driver tag key", params: map[string]string{"tags." + tagDriver: "a"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseBucketParameters(tt.params)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBucketParameters() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if code := status.Code(err); code != codes.InvalidArgument {
+					t.Errorf("parseBucketParameters() code = %s, want %s", code, codes.InvalidArgument)
+				}
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseBucketParameters() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseBucketParametersTagLimit(t *testing.T) {
+	params := map[string]string{}
+	for i := 0; i < maxTags-driverTagCount; i++ {
+		params[fmt.Sprintf("tags.key-%d", i)] = "v"
+	}
+	if _, err := parseBucketParameters(params); err != nil {
+		t.Fatalf("parseBucketParameters() with %d tags error = %v", len(params), err)
+	}
+	params["tags.one-too-many"] = "v"
+	if _, err := parseBucketParameters(params); err == nil {
+		t.Fatalf("parseBucketParameters() with %d tags succeeded", len(params))
+	}
+}
+
+func TestParseBucketDeleteContext(t *testing.T) {
+	params := map[string]string{
+		"purgeOnDelete":       "true",
+		"removedInNewVersion": "x",
+	}
+	if _, err := parseBucketParameters(params); err == nil {
+		t.Fatal("parseBucketParameters() accepted an unknown parameter")
+	}
+	got, err := parseBucketDeleteContext(params)
+	if err != nil {
+		t.Fatalf("parseBucketDeleteContext() error = %v", err)
+	}
+	if !got.purgeOnDelete {
+		t.Errorf("purgeOnDelete = false, want true")
+	}
+
+	// known parameters are still validated
+	if _, err := parseBucketDeleteContext(map[string]string{"purgeOnDelete": "yes"}); err == nil {
+		t.Error("parseBucketDeleteContext() accepted an invalid value")
+	}
+}
+
+func TestParseAccessParameters(t *testing.T) {
+	validUntil := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		params  map[string]string
+		want    *accessParameters
+		wantErr bool
+	}{
+		{
+			name: "no parameters",
+			want: &accessParameters{actions: s3cli.AllowedActions},
+		},
+		{
+			name:   "profile",
+			params: map[string]string{"profile": "read-only"},
+			want:   &accessParameters{actions: s3cli.ReadOnlyActions},
+		},
+		{
+			name:   "actions without duplicates",
+			params: map[string]string{"actions": "s3:GetObject, s3:ListBucket,s3:GetObject"},
+			want:   &accessParameters{actions: []s3cli.Action{s3cli.GetObject, s3cli.ListBucket}},
+		},
+		{
+			name:   "prefix narrows the default actions",
+			params: map[string]string{"prefix": "team-a"},
+			want:   &accessParameters{actions: s3cli.ReadWriteActions, prefix: "team-a/"},
+		},
+		{
+			name:   "prefix with object actions",
+			params: map[string]string{"prefix": "team-a/", "actions": "s3:GetObject,s3:ListBucket"},
+			want:   &accessParameters{actions: []s3cli.Action{s3cli.GetObject, s3cli.ListBucket}, prefix: "team-a/"},
+		},
+		{
+			name: "conditions in key order",
+			params: map[string]string{
+				"allowedCIDRs": "10.0.0.0/8, 192.168.1.1",
+				"deniedCIDRs":  "fd00::1",
+				"requireTLS":   "true",
+				"validUntil":   "2030-01-01T00:00:00Z",
+			},
+			want: &accessParameters{
+				actions: s3cli.AllowedActions,
+				conditions: []s3cli.Condition{
+					s3cli.SourceIPIn("10.0.0.0/8", "192.168.1.1/32"),
+					s3cli.SourceIPNotIn("fd00::1/128"),
+					s3cli.SecureTransport(),
+					s3cli.CurrentTimeBefore(validUntil),
+				},
+			},
+		},
+		{
+			name:   "TLS not required",
+			params: map[string]string{"requireTLS": "false"},
+			want:   &accessParameters{actions: s3cli.AllowedActions},
+		},
+		{
+			name:   "key rotation enabled",
+			params: map[string]string{"keyRotation": "true"},
+			want:   &accessParameters{actions: s3cli.AllowedActions, keyRotation: true},
+		},
+		{
+			name:   "naming parameters",
+			params: map[string]string{"naming.team": "a", "naming.env": "prod"},
+			want:   &accessParameters{actions: s3cli.AllowedActions, naming: map[string]string{"team": "a", "env": "prod"}},
+		},
+		{name: "unknown parameter", params: map[string]string{"profiles": "read-only"}, wantErr: true},
+		{name: "unknown profile", params: map[string]string{"profile": "owner"}, wantErr: true},
+		{name: "unknown action", params: map[string]string{"actions": "s3:GetObjects"}, wantErr: true},
+		{name: "profile and actions", params: map[string]string{"profile": "read-only", "actions": "s3:GetObject"}, wantErr: true},
+		{name: "bucket action with prefix", params: map[string]string{"prefix": "a/", "actions": "s3:PutLifecycleConfiguration"}, wantErr: true},
+		{name: "prefix with wildcard", params: map[string]string{"prefix": "team-*"}, wantErr: true},
+		{name: "prefix with leading slash", params: map[string]string{"prefix": "/team-a"}, wantErr: true},
+		{name: "empty prefix", params: map[string]string{"prefix": "/"}, wantErr: true},
+		{name: "invalid CIDR", params: map[string]string{"allowedCIDRs": "10.0.0.0/33"}, wantErr: true},
+		{name: "empty CIDR", params: map[string]string{"deniedCIDRs": "10.0.0.0/8,"}, wantErr: true},
+		{name: "invalid timestamp", params: map[string]string{"validUntil": "2030-01-01"}, wantErr: true},
+		{name: "invalid bool", params: map[string]string{"keyRotation": "no"}, wantErr: true},
+		{name: "empty naming key", params: map[string]string{"naming.": "a"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAccessParameters(tt.params)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAccessParameters() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if code := status.Code(err); code != codes.InvalidArgument {
+					t.Errorf("parseAccessParameters() code = %s, want %s", code, codes.InvalidArgument)
+				}
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseAccessParameters() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveLifecycleConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+
+	// documents are read as YAML, which includes JSON
+	valid := map[string]s3cli.LifecycleRules{
+		write("yaml.yaml", "expirationDays: 30\nabortIncompleteMultipartUploadDays: 2\n"): {ExpirationDays: 30, AbortIncompleteMultipartUploadDays: 2},
+		write("json.json", `{"noncurrentVersionExpirationDays": 7}`):                      {NoncurrentVersionExpirationDays: 7},
+	}
+	for ref, want := range valid {
+		p := &bucketParameters{lifecycleConfigRef: ref}
+		if err := p.resolveLifecycleConfig(dir); err != nil {
+			t.Errorf("resolveLifecycleConfig(%q) error = %v", ref, err)
+		} else if p.lifecycle != want {
+			t.Errorf("resolveLifecycleConfig(%q) lifecycle = %+v, want %+v", ref, p.lifecycle, want)
+		}
+	}
+
+	invalid := []string{
+		write("unknown.yaml", "expirationDay: 30\n"),
+		write("empty.yaml", "{}\n"),
+		write("negative.yaml", "expirationDays: -1\n"),
+		"missing.yaml",
+	}
+	for _, ref := range invalid {
+		p := &bucketParameters{lifecycleConfigRef: ref}
+		if err := p.resolveLifecycleConfig(dir); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("resolveLifecycleConfig(%q) error = %v, want %s", ref, err, codes.InvalidArgument)
+		}
+	}
+
+	if err := (&bucketParameters{lifecycleConfigRef: "yaml.yaml"}).resolveLifecycleConfig(""); err == nil {
+		t.Error("resolveLifecycleConfig() succeeded without a lifecycle document directory")
+	}
+	if err := (&bucketParameters{}).resolveLifecycleConfig(""); err != nil {
+		t.Errorf("resolveLifecycleConfig() without a reference error = %v", err)
+	}
+}
@@ -17,8 +17,10 @@ package driver
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
 
-	"github.com/aws/aws-sdk-go/aws/awserr"
 	ntnxIam "github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/admin"
 	s3cli "github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/util/s3client"
 	"google.golang.org/grpc/codes"
@@ -27,13 +29,21 @@ import (
 	cosi "sigs.k8s.io/container-object-storage-interface-spec"
 )
 
-// contains two clients
+// contains two clients for each object store it serves
 // 1.) for ntnxIamClientOps : mainly for user related operations
 // 2.) for S3 operations : mainly for bucket related operations
 type ProvisionerServer struct {
-	provisioner   string
-	s3Client      *s3cli.S3Agent
-	ntnxIamClient *ntnxIam.API
+	provisioner string
+	// object stores served by the driver, BucketClasses pick one through the objectStore parameter
+	objectStores *objectStoreRegistry
+	// directory holding the documents referenced by the lifecycleConfigRef parameter
+	lifecycleConfigDir string
+	// identifier of the kubernetes cluster recorded in the bucket tags
+	clusterID string
+	// quarantine enables the quarantineOnDelete BucketClass parameter
+	quarantine bool
+	// naming renders the username and display name of the IAM user of a grant
+	naming *userNaming
 }
 
 // ProvisionerCreateBucket is a method for creating buckets
@@ -53,105 +63,512 @@ func (s *ProvisionerServer) DriverCreateBucket(ctx context.Context,
 	bucketName := req.GetName()
 	klog.V(3).InfoS("Creating Bucket", "name", bucketName)
 
-	err := s.s3Client.CreateBucket(bucketName)
+	// Validate the BucketClass parameters before touching the object store
+	params, err := parseBucketParameters(req.GetParameters())
 	if err != nil {
-		// Check to see if the bucket already exists by above API
+		klog.ErrorS(err, "invalid BucketClass parameters", "bucketName", bucketName)
+		return nil, err
+	}
+	if err := params.resolveLifecycleConfig(s.lifecycleConfigDir); err != nil {
+		klog.ErrorS(err, "invalid lifecycle configuration", "bucketName", bucketName)
+		return nil, err
+	}
+	store, err := s.objectStores.forParameter(params.objectStore)
+	if err != nil {
+		klog.ErrorS(err, "invalid object store", "bucketName", bucketName)
+		return nil, err
+	}
+	if params.quarantineOnDelete && !s.quarantine {
+		klog.ErrorS(errQuarantineDisabled, "cannot quarantine bucket on delete", "bucketName", bucketName)
+		return nil, status.Error(codes.FailedPrecondition, "quarantineOnDelete requires the driver to run with quarantine enabled")
+	}
+	if params.quotaBytes != 0 && store.ntnxIamClient.ObjectStoreUUID == "" {
+		klog.ErrorS(errNoObjectStoreUUID, "cannot set bucket quota", "bucketName", bucketName)
+		return nil, status.Error(codes.FailedPrecondition, "quotaGiB requires the driver to be configured with the object store UUID")
+	}
+
+	adopted := false
+	err = store.s3Client.CreateBucket(bucketName, params.objectLock != "", params.region)
+	switch {
+	case errors.Is(err, s3cli.ErrBucketAlreadyOwnedByYou):
+		// The bucket exists in the admin account, either from an earlier attempt
+		// of this request or as a pre-existing bucket that may be adopted
+		if adopted, err = s.adoptBucket(store, bucketName, params); err != nil {
+			return nil, err
+		}
+	case errors.Is(err, s3cli.ErrBucketAlreadyExists):
+		klog.ErrorS(err, "bucket name is taken by another account", "bucketName", bucketName)
+		return nil, status.Errorf(codes.AlreadyExists, "bucket %q already exists and is owned by another account", bucketName)
+	case err != nil:
 		klog.ErrorS(err, "failed to create bucket", "bucketName", bucketName)
-		return nil, status.Error(codes.Internal, "failed to create bucket")
+		return nil, s.statusError(err, "failed to create bucket")
+	default:
+		klog.InfoS("Successfully created Backend Bucket on Nutanix Objects", "bucketName", bucketName, "objectStore", store.name)
 	}
-	klog.InfoS("Successfully created Backend Bucket on Nutanix Objects", "bucketName", bucketName)
 
-	// Not sure what bucketInfo Stores
+	if err := s.configureBucket(ctx, store, bucketName, params, !adopted || params.tagAdopted); err != nil {
+		klog.ErrorS(err, "failed to configure bucket", "bucketName", bucketName)
+		return nil, s.statusError(err, "failed to configure bucket")
+	}
+
+	// the BucketId names the object store, so that later requests on the bucket reach it
 	return &cosi.DriverCreateBucketResponse{
-		BucketId: bucketName,
+		BucketId: store.bucketID(bucketName),
 	}, nil
 }
 
+// adoptBucket decides whether an existing bucket of the admin account may be used for the request.
+// Buckets already tagged by this driver are reused as is, so that retries of DriverCreateBucket succeed.
+// Other buckets are only taken over when the BucketClass sets adoptExisting, in which case adopted is true.
+func (s *ProvisionerServer) adoptBucket(store *objectStore, bucketName string, params *bucketParameters) (adopted bool, err error) {
+	exists, err := store.s3Client.BucketExists(bucketName)
+	if err != nil {
+		klog.ErrorS(err, "existing bucket is not reachable with the admin credentials", "bucketName", bucketName)
+		return false, s.statusError(err, fmt.Sprintf("existing bucket %q is not reachable", bucketName))
+	}
+	if !exists {
+		// deleted since CreateBucket was called, let the sidecar retry
+		return false, status.Errorf(codes.Unavailable, "bucket %q disappeared while being created", bucketName)
+	}
+
+	tags, err := store.s3Client.GetBucketTagging(bucketName)
+	if err != nil {
+		klog.ErrorS(err, "failed to fetch tags of existing bucket", "bucketName", bucketName)
+		return false, s.statusError(err, fmt.Sprintf("failed to fetch tags of existing bucket %q", bucketName))
+	}
+
+	owner, owned := tags[tagDriver]
+	switch {
+	case owned && owner == s.provisioner:
+		klog.InfoS("Bucket already created by this driver", "bucketName", bucketName)
+	case owned:
+		return false, status.Errorf(codes.AlreadyExists, "bucket %q already exists and is managed by driver %q", bucketName, owner)
+	case !params.adoptExisting:
+		return false, status.Errorf(codes.AlreadyExists, "bucket %q already exists and is not managed by this driver, set adoptExisting to take it over", bucketName)
+	default:
+		adopted = true
+	}
+
+	// the region of a bucket is fixed when it is created, an existing bucket must already be in the requested one
+	if params.region != "" {
+		location, err := store.s3Client.GetBucketLocation(bucketName)
+		if err != nil {
+			klog.ErrorS(err, "failed to fetch location of existing bucket", "bucketName", bucketName)
+			return false, s.statusError(err, fmt.Sprintf("failed to fetch location of existing bucket %q", bucketName))
+		}
+		if location != params.region {
+			return false, status.Errorf(codes.FailedPrecondition, "existing bucket %q is in region %q instead of %q", bucketName, location, params.region)
+		}
+	}
+
+	if adopted {
+		klog.InfoS("Adopting existing bucket", "bucketName", bucketName, "tagAdopted", params.tagAdopted)
+	}
+	return adopted, nil
+}
+
+// configureBucket applies the BucketClass parameters to a bucket right after it was created.
+// The provenance tags are only written when tagBucket is set.
+func (s *ProvisionerServer) configureBucket(ctx context.Context, store *objectStore, bucketName string, params *bucketParameters, tagBucket bool) error {
+	if tagBucket {
+		tags, err := store.s3Client.GetBucketTagging(bucketName)
+		if err != nil {
+			return fmt.Errorf("failed to fetch bucket tags: %w", err)
+		}
+		changed, err := mergeTags(tags, s.bucketTags(params))
+		if err != nil {
+			return err
+		}
+		if changed {
+			if err := store.s3Client.PutBucketTagging(bucketName, tags); err != nil {
+				return fmt.Errorf("failed to set bucket tags: %w", err)
+			}
+			klog.InfoS("Successfully set bucket tags", "bucketName", bucketName, "tags", tags)
+		}
+	}
+
+	if params.versioning != "" {
+		current, err := store.s3Client.GetBucketVersioning(bucketName)
+		if err != nil {
+			return fmt.Errorf("failed to fetch versioning state: %w", err)
+		}
+		if current != params.versioning {
+			if err := store.s3Client.PutBucketVersioning(bucketName, params.versioning); err != nil {
+				return fmt.Errorf("failed to set versioning state to %s: %w", params.versioning, err)
+			}
+			klog.InfoS("Successfully set bucket versioning", "bucketName", bucketName, "state", params.versioning)
+		}
+	}
+
+	if params.objectLock != "" {
+		if err := store.s3Client.PutObjectLockConfiguration(bucketName, params.objectLock, params.retentionDays); err != nil {
+			return fmt.Errorf("failed to set default retention: %w", err)
+		}
+		klog.InfoS("Successfully set default retention", "bucketName", bucketName,
+			"mode", params.objectLock, "days", params.retentionDays)
+	}
+
+	if !params.lifecycle.IsEmpty() {
+		if err := store.s3Client.PutBucketLifecycle(bucketName, params.lifecycle); err != nil {
+			return fmt.Errorf("failed to set lifecycle configuration: %w", err)
+		}
+		klog.InfoS("Successfully set lifecycle configuration", "bucketName", bucketName, "rules", params.lifecycle)
+	}
+
+	if params.quotaBytes != 0 {
+		quota, err := store.ntnxIamClient.GetBucketQuota(ctx, bucketName)
+		if err != nil {
+			return fmt.Errorf("failed to fetch bucket quota: %w", err)
+		}
+		if quota.SizeBytes != params.quotaBytes || quota.EnforcementType != ntnxIam.QuotaEnforcementHard {
+			if err := store.ntnxIamClient.SetBucketQuota(ctx, bucketName, params.quotaBytes); err != nil {
+				return fmt.Errorf("failed to set bucket quota: %w", err)
+			}
+			klog.InfoS("Successfully set bucket quota", "bucketName", bucketName, "bytes", params.quotaBytes)
+		}
+	}
+	return nil
+}
+
 func (s *ProvisionerServer) DriverDeleteBucket(ctx context.Context,
 	req *cosi.DriverDeleteBucketRequest) (*cosi.DriverDeleteBucketResponse, error) {
-	klog.InfoS("Deleting bucket", "id", req.GetBucketId())
-	if _, err := s.s3Client.DeleteBucket(req.GetBucketId()); err != nil {
-		klog.ErrorS(err, "failed to delete bucket %q", req.GetBucketId())
-		return nil, status.Error(codes.Internal, "failed to delete bucket")
+	bucketID := req.GetBucketId()
+	klog.InfoS("Deleting bucket", "id", bucketID)
+
+	store, bucketName, err := s.objectStores.forBucketID(bucketID)
+	if err != nil {
+		klog.ErrorS(err, "cannot route bucket", "id", bucketID)
+		return nil, err
 	}
-	klog.InfoS("Successfully deleted Bucket", "id", req.GetBucketId())
+
+	params, err := parseBucketDeleteContext(req.GetDeleteContext())
+	if err != nil {
+		klog.ErrorS(err, "invalid delete context", "id", bucketID)
+		return nil, err
+	}
+
+	// a bucket that is already gone is deleted, whatever step finds it missing
+	if params.quarantineOnDelete {
+		if !s.quarantine {
+			// no reaper runs, a quarantined bucket would never be deleted: the deletion is retried
+			// until quarantine is enabled again or quarantineOnDelete is removed from the BucketClass
+			klog.ErrorS(errQuarantineDisabled, "cannot quarantine bucket on delete", "id", bucketID)
+			return nil, status.Error(codes.FailedPrecondition, "quarantineOnDelete requires the driver to run with quarantine enabled")
+		}
+		if err := store.quarantine.Add(bucketName); err != nil {
+			if isS3ErrorCode(err, s3cli.ErrNoSuchBucket) {
+				klog.InfoS("Bucket already deleted", "id", bucketID)
+				return &cosi.DriverDeleteBucketResponse{}, nil
+			}
+			klog.ErrorS(err, "failed to quarantine bucket", "id", bucketID)
+			return nil, s.statusError(err, "failed to quarantine bucket")
+		}
+		klog.InfoS("Bucket quarantined until the end of the grace period", "id", bucketID)
+		return &cosi.DriverDeleteBucketResponse{}, nil
+	}
+
+	if params.purgeOnDelete {
+		if err := store.s3Client.PurgeBucket(bucketName); err != nil {
+			if isS3ErrorCode(err, s3cli.ErrNoSuchBucket) {
+				klog.InfoS("Bucket already deleted", "id", bucketID)
+				return &cosi.DriverDeleteBucketResponse{}, nil
+			}
+			klog.ErrorS(err, "failed to purge bucket", "id", bucketID)
+			return nil, s.statusError(err, "failed to purge bucket")
+		}
+	}
+
+	if _, err := store.s3Client.DeleteBucket(bucketName); err != nil {
+		switch {
+		case isS3ErrorCode(err, s3cli.ErrNoSuchBucket):
+			klog.InfoS("Bucket already deleted", "id", bucketID)
+			return &cosi.DriverDeleteBucketResponse{}, nil
+		case isS3ErrorCode(err, s3cli.ErrBucketNotEmpty):
+			klog.ErrorS(err, "bucket is not empty", "id", bucketID)
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"bucket %q is not empty, remove its objects or set purgeOnDelete in the BucketClass", bucketName)
+		}
+		klog.ErrorS(err, "failed to delete bucket", "id", bucketID)
+		return nil, s.statusError(err, "failed to delete bucket")
+	}
+	klog.InfoS("Successfully deleted Bucket", "id", bucketID)
 
 	return &cosi.DriverDeleteBucketResponse{}, nil
 }
 
+// DriverGrantBucketAccess shares a bucket with a new IAM user. It never fails with AlreadyExists:
+// the sidecar takes that code for a successful grant and reads the response, which is then nil.
+// Conflicts, such as a 409 from Prism Central, are reported as Aborted and retried.
 func (s *ProvisionerServer) DriverGrantBucketAccess(ctx context.Context,
 	req *cosi.DriverGrantBucketAccessRequest) (*cosi.DriverGrantBucketAccessResponse, error) {
-	// Form the username for this new user.
-	// username is formed by concatenating the account name prefix
-	// stored in req which is of the form- "ba-<BucketAccessUUID>"
-	// with the suffix "@nutanix.com"
-	userName := req.GetName() + "@nutanix.com"
-	displayName := s.ntnxIamClient.AccountName + "_" + req.GetName()
-	bucketName := req.GetBucketId()
+	resp, err := s.grantBucketAccess(ctx, req)
+	if status.Code(err) == codes.AlreadyExists {
+		return nil, withCode(err, codes.Aborted)
+	}
+	return resp, err
+}
+
+func (s *ProvisionerServer) grantBucketAccess(ctx context.Context,
+	req *cosi.DriverGrantBucketAccessRequest) (*cosi.DriverGrantBucketAccessResponse, error) {
+	store, bucketName, err := s.objectStores.forBucketID(req.GetBucketId())
+	if err != nil {
+		klog.ErrorS(err, "cannot route bucket", "id", req.GetBucketId())
+		return nil, err
+	}
+
+	params, err := parseAccessParameters(req.GetParameters())
+	if err != nil {
+		klog.ErrorS(err, "invalid BucketAccessClass parameters", "name", req.GetName())
+		return nil, err
+	}
+
+	// Form the username for this new user from the naming templates.
+	// By default the name in req, which is of the form "ba-<BucketAccessUUID>",
+	// is suffixed with "@nutanix.com"
+	userName, displayName, err := s.naming.names(namingData{
+		Name:        req.GetName(),
+		AccountName: store.ntnxIamClient.AccountName,
+		Parameters:  params.naming,
+	})
+	if err != nil {
+		klog.ErrorS(err, "invalid IAM user name", "name", req.GetName())
+		return nil, status.Errorf(codes.InvalidArgument, "invalid IAM user name: %v", err)
+	}
 
 	klog.InfoS("Granting user accessPolicy to bucket", "userName", userName, "displayName",
 		displayName, "bucketName", bucketName)
 
-	// Format : {type: "external", email: <userName>@nutanix.com, displayname: <accountName>_<userName> (optional)}
-	user, err := s.ntnxIamClient.CreateUser(ctx, userName, displayName)
+	region, err := store.bucketRegion(bucketName)
+	if err != nil {
+		klog.ErrorS(err, "failed to resolve bucket region", "bucketName", bucketName)
+		return nil, s.statusError(err, "failed to resolve bucket region")
+	}
+	klog.V(3).InfoS("Resolved bucket access permissions", "userName", userName, "actions", params.actions, "prefix", params.prefix)
+
+	// every completed step is undone if a later one fails, so that a failed grant leaves no user behind
+	tx := newSaga(s.provisioner, "grant bucket access")
+
+	user, key, stale, err := s.grantUser(ctx, store, tx, userName, displayName)
 	if err != nil {
 		klog.ErrorS(err, "failed to create an IAM user for Nutanix Objects")
-		return nil, err
+		return nil, tx.abort(err, "failed to create IAM user")
 	}
 
 	// Fetch Bucket Policy
-	policy, err := s.s3Client.GetBucketPolicy(bucketName)
+	policy, err := store.s3Client.GetBucketPolicy(bucketName)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok && aerr.Code() != "NoSuchBucketPolicy" {
-			return nil, status.Error(codes.Internal, "fetching policy failed")
+		if !isS3ErrorCode(err, s3cli.ErrNoSuchBucketPolicy) {
+			klog.ErrorS(err, "failed to fetch policy", "bucketName", bucketName)
+			return nil, tx.abort(err, "fetching policy failed")
 		}
 	}
 
-	// Share bucket with the newly created IAM user
-	statement := s3cli.NewPolicyStatement().
-		WithSID(userName).
-		ForPrincipals(userName).
-		ForResources(bucketName).
-		ForSubResources(bucketName).
-		Allows().
-		Actions(s3cli.AllowedActions...)
+	// Share bucket with the IAM user, statements of a previous attempt are replaced
+	statements := grantStatements(userName, bucketName, params)
 	if policy == nil {
-		policy = s3cli.NewBucketPolicy(*statement)
+		policy = s3cli.NewBucketPolicy(statements...)
 	} else {
-		policy = policy.ModifyBucketPolicy(*statement)
+		policy = policy.ModifyBucketPolicy(statements...)
 	}
-	_, err = s.s3Client.PutBucketPolicy(bucketName, *policy)
+	_, err = store.s3Client.PutBucketPolicy(bucketName, *policy)
 	if err != nil {
 		klog.ErrorS(err, "failed to set policy")
-		return nil, status.Error(codes.Internal, "failed to set policy")
+		return nil, tx.abort(err, "failed to set policy")
+	}
+
+	// the keys of earlier attempts never reached a Secret, they are deleted so that only the returned key is valid
+	for _, id := range stale {
+		if err := store.ntnxIamClient.DeleteAccessKey(ctx, user.UUID, id); err != nil {
+			klog.ErrorS(err, "failed to delete access key of an earlier attempt", "userName", userName, "accessKeyID", id)
+			return nil, tx.abort(err, "failed to delete access key of an earlier attempt")
+		}
+		klog.InfoS("Deleted access key of an earlier attempt", "userName", userName, "accessKeyID", id)
 	}
 
 	return &cosi.DriverGrantBucketAccessResponse{
-		AccountId:   user.Users[0].UUID,
-		Credentials: fetchUserCredentials(user, s.ntnxIamClient.Endpoint),
+		AccountId:   userName,
+		Credentials: store.fetchUserCredentials(key, region),
 	}, nil
 }
 
+// grantUser returns the IAM user of a grant along with a new access key.
+// A retried grant finds the user created by the previous attempt, which gets a new access key
+// since the secret of an existing key cannot be read back. The keys minted by earlier attempts
+// are returned as stale, only the new key reaches the BucketAccess Secret.
+// An existing user is only taken as an earlier attempt when it carries the display name rendered
+// for the grant, any other user with that name is left untouched and fails the grant with errUserNotOwned.
+// The user or access key created is recorded in tx.
+func (s *ProvisionerServer) grantUser(ctx context.Context, store *objectStore, tx *saga, userName, displayName string) (
+	user ntnxIam.NutanixUser, key ntnxIam.BucketsAccessKey, stale []string, err error) {
+	user, err = store.ntnxIamClient.GetUserByName(ctx, userName)
+	if errors.Is(err, ntnxIam.ErrUserNotFound) {
+		// Format : {type: "external", email: <userName>@nutanix.com, displayname: <accountName>_<userName> (optional)}
+		resp, err := store.ntnxIamClient.CreateUser(ctx, userName, displayName)
+		if err == nil {
+			user := resp.Users[0]
+			tx.done("create user", func(ctx context.Context) error {
+				return store.ntnxIamClient.RemoveUser(ctx, user.UUID)
+			})
+			return user, user.BucketsAccessKeys[0], nil, nil
+		}
+		if !isConflict(err) {
+			return user, key, nil, err
+		}
+		// a concurrent attempt created the user since it was looked up
+		klog.InfoS("IAM user created concurrently, looking it up again", "userName", userName)
+		user, err = store.ntnxIamClient.GetUserByName(ctx, userName)
+	}
+	if err != nil {
+		return user, key, nil, fmt.Errorf("failed to look up user: %w", err)
+	}
+	if user.DisplayName != displayName {
+		klog.ErrorS(errUserNotOwned, "IAM user was not created for this grant", "userName", userName,
+			"displayName", user.DisplayName, "wantDisplayName", displayName)
+		return user, key, nil, fmt.Errorf("user %q has display name %q instead of %q: %w",
+			userName, user.DisplayName, displayName, errUserNotOwned)
+	}
+
+	keys, err := store.ntnxIamClient.ListAccessKeys(ctx, user.UUID)
+	if err != nil {
+		return user, key, nil, fmt.Errorf("failed to list access keys: %w", err)
+	}
+	for _, k := range keys {
+		stale = append(stale, k.AccessKeyID)
+	}
+
+	klog.InfoS("IAM user already exists, creating a new access key", "userName", userName, "id", user.UUID)
+	key, err = store.ntnxIamClient.CreateAccessKey(ctx, user.UUID)
+	if err != nil {
+		return user, key, nil, fmt.Errorf("failed to create access key: %w", err)
+	}
+	tx.done("create access key", func(ctx context.Context) error {
+		return store.ntnxIamClient.DeleteAccessKey(ctx, user.UUID, key.AccessKeyID)
+	})
+	return user, key, stale, nil
+}
+
 func (s *ProvisionerServer) DriverRevokeBucketAccess(ctx context.Context,
 	req *cosi.DriverRevokeBucketAccessRequest) (*cosi.DriverRevokeBucketAccessResponse, error) {
 
-	klog.InfoS("Deleting user", "id", req.GetAccountId())
+	accountID := req.GetAccountId()
+	store, bucketName, err := s.objectStores.forBucketID(req.GetBucketId())
+	if err != nil {
+		klog.ErrorS(err, "cannot route bucket", "id", req.GetBucketId())
+		return nil, err
+	}
+
+	// the bucket policy names the user by username, which the account ID carries
+	userName, named := accountUsername(accountID)
+	if !named {
+		// grants made before the account ID named the user carry its UUID, the user has to be looked up
+		user, err := store.ntnxIamClient.GetUser(ctx, accountID)
+		if errors.Is(err, ntnxIam.ErrUserNotFound) {
+			klog.InfoS("User already deleted, its bucket policy statements cannot be found without its username", "id", accountID, "bucketName", bucketName)
+			return &cosi.DriverRevokeBucketAccessResponse{}, nil
+		}
+		if err != nil {
+			klog.ErrorS(err, "failed to fetch user", "id", accountID)
+			return nil, s.statusError(err, "failed to fetch user")
+		}
+		userName = user.Username
+	}
+
+	// the policy is cleaned up first, whether or not the user still exists
+	klog.InfoS("Revoking user accessPolicy to bucket", "userName", userName, "bucketName", bucketName)
+	if err := store.revokeBucketPolicy(bucketName, userName); err != nil {
+		klog.ErrorS(err, "failed to revoke bucket policy", "userName", userName, "bucketName", bucketName)
+		return nil, s.statusError(err, "failed to revoke bucket policy")
+	}
 
-	err := s.ntnxIamClient.RemoveUser(ctx, req.GetAccountId())
+	user, err := store.accountUser(ctx, accountID)
+	if errors.Is(err, ntnxIam.ErrUserNotFound) {
+		klog.InfoS("User already deleted", "id", accountID)
+		return &cosi.DriverRevokeBucketAccessResponse{}, nil
+	}
+	if err != nil {
+		klog.ErrorS(err, "failed to fetch user", "id", accountID)
+		return nil, s.statusError(err, "failed to fetch user")
+	}
+
+	klog.InfoS("Deleting user", "userName", userName, "id", user.UUID)
+
+	// the revocation only succeeds once the user, and so its access keys, are deleted
+	err = store.ntnxIamClient.RemoveUser(ctx, user.UUID)
 	if err != nil {
-		klog.ErrorS(err, "failed to delete user")
+		klog.ErrorS(err, "failed to delete user", "id", user.UUID)
+		return nil, s.statusError(err, "failed to delete user")
 	}
+	klog.InfoS("Successfully revoked bucket access", "id", accountID, "bucketName", bucketName)
 	return &cosi.DriverRevokeBucketAccessResponse{}, nil
 }
 
-func fetchUserCredentials(user ntnxIam.NutanixUserResp, endpoint string) map[string]*cosi.CredentialDetails {
+// accountUsername returns the username carried by the account ID of a grant.
+// Grants return the username of their IAM user as account ID, named is false for the
+// account IDs of earlier grants, which are the UUID of the user.
+func accountUsername(accountID string) (userName string, named bool) {
+	// usernames are email addresses, UUIDs never contain an @
+	if strings.Contains(accountID, "@") {
+		return accountID, true
+	}
+	return "", false
+}
+
+// accountUser returns the IAM user of the account ID of a grant.
+// ErrUserNotFound is returned when there is no such user.
+func (o *objectStore) accountUser(ctx context.Context, accountID string) (ntnxIam.NutanixUser, error) {
+	if userName, named := accountUsername(accountID); named {
+		return o.ntnxIamClient.GetUserByName(ctx, userName)
+	}
+	return o.ntnxIamClient.GetUser(ctx, accountID)
+}
+
+// revokeBucketPolicy removes userName from the bucket policy.
+// The policy is deleted once no statement is left.
+func (o *objectStore) revokeBucketPolicy(bucketName, userName string) error {
+	policy, err := o.s3Client.GetBucketPolicy(bucketName)
+	if err != nil {
+		if isS3ErrorCode(err, s3cli.ErrNoSuchBucketPolicy) || isS3ErrorCode(err, s3cli.ErrNoSuchBucket) {
+			// nothing left to revoke
+			return nil
+		}
+		return err
+	}
+
+	policy = revokeStatements(policy, userName)
+	if len(policy.Statement) == 0 {
+		err = o.s3Client.DeleteBucketPolicy(bucketName)
+	} else {
+		_, err = o.s3Client.PutBucketPolicy(bucketName, *policy)
+	}
+	if isS3ErrorCode(err, s3cli.ErrNoSuchBucket) {
+		// the bucket was deleted meanwhile
+		return nil
+	}
+	return err
+}
+
+// bucketRegion returns the region the bucket was created in by the region BucketClass parameter,
+// or the region of the object store for buckets in the default region
+func (o *objectStore) bucketRegion(bucketName string) (string, error) {
+	location, err := o.s3Client.GetBucketLocation(bucketName)
+	if err != nil {
+		return "", err
+	}
+	if location != "" {
+		return location, nil
+	}
+	return o.region, nil
+}
+
+// fetchUserCredentials returns the credentials of a grant, limited to the keys the COSI sidecar
+// copies to BucketInfo. The CA bundle of the object store is published by the caBundlePublisher.
+func (o *objectStore) fetchUserCredentials(key ntnxIam.BucketsAccessKey, region string) map[string]*cosi.CredentialDetails {
 
 	secretsMap := make(map[string]string)
-	secretsMap["accessKeyID"] = user.Users[0].BucketsAccessKeys[0].AccessKeyID
-	secretsMap["accessSecretKey"] = user.Users[0].BucketsAccessKeys[0].SecretAccessKey
-	secretsMap["endpoint"] = endpoint
-	// region mapping needs to be updated
-	secretsMap["region"] = "us-east-1"
+	secretsMap["accessKeyID"] = key.AccessKeyID
+	secretsMap["accessSecretKey"] = key.SecretAccessKey
+	secretsMap["endpoint"] = o.currentEndpoint()
+	secretsMap["region"] = region
 
 	creds := &cosi.CredentialDetails{
 		Secrets: secretsMap,
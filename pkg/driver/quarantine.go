@@ -0,0 +1,322 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	s3cli "github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/util/s3client"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// tagDeletedAt marks a quarantined bucket with the time DriverDeleteBucket was called
+	tagDeletedAt = tagPrefix + "deleted-at"
+	// tagGrantsPrefix numbers the tags recording the grant statements stripped from the policy of a
+	// quarantined bucket. The statements are compressed and split over as many tags as needed.
+	tagGrantsPrefix = tagPrefix + "quarantined-grants-"
+
+	// DefaultQuarantineGracePeriod is how long a quarantined bucket is kept before the reaper deletes it
+	DefaultQuarantineGracePeriod = 7 * 24 * time.Hour
+
+	// quarantineReapInterval is how often the reaper looks for expired quarantined buckets
+	quarantineReapInterval = time.Hour
+)
+
+// QuarantinedBucket is a bucket waiting for the reaper
+type QuarantinedBucket struct {
+	Name      string
+	DeletedAt time.Time
+}
+
+// Quarantine manages the buckets soft-deleted by a driver
+type Quarantine struct {
+	s3Client    *s3cli.S3Agent
+	provisioner string
+	gracePeriod time.Duration
+}
+
+// NewQuarantine returns the quarantine of the buckets created by the given driver
+func NewQuarantine(s3Client *s3cli.S3Agent, provisioner string, gracePeriod time.Duration) *Quarantine {
+	return &Quarantine{
+		s3Client:    s3Client,
+		provisioner: provisioner,
+		gracePeriod: gracePeriod,
+	}
+}
+
+// Add quarantines a bucket: the grants of the driver are stripped from its policy and the bucket
+// is tagged with the deletion time. The statements written by anyone else are left in place.
+// The stripped statements are recorded in the bucket tags before they are removed, so that Restore
+// can put them back. Adding an already quarantined bucket keeps its original deletion time.
+func (q *Quarantine) Add(bucketName string) error {
+	tags, err := q.s3Client.GetBucketTagging(bucketName)
+	if err != nil {
+		return fmt.Errorf("failed to fetch bucket tags: %w", err)
+	}
+	policy, err := q.s3Client.GetBucketPolicy(bucketName)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != s3cli.ErrNoSuchBucketPolicy {
+			return fmt.Errorf("failed to fetch bucket policy: %w", err)
+		}
+	}
+
+	// grants recorded by an earlier attempt are kept, the statements found now are added to them
+	recorded, err := quarantinedGrants(tags)
+	if err != nil {
+		return err
+	}
+	stripped := []s3cli.PolicyStatement{}
+	if policy != nil {
+		stripped = policy.ExtractStatements(isGrantStatement)
+	}
+	grants := s3cli.NewBucketPolicy(recorded...).ModifyBucketPolicy(stripped...).Statement
+
+	changed := false
+	if _, ok := tags[tagDeletedAt]; !ok {
+		tags[tagDriver] = q.provisioner
+		tags[tagDeletedAt] = time.Now().UTC().Format(time.RFC3339)
+		changed = true
+	}
+	if len(stripped) > 0 {
+		if err := setQuarantinedGrants(tags, grants); err != nil {
+			return fmt.Errorf("cannot record the grants of bucket %q: %w", bucketName, err)
+		}
+		changed = true
+	}
+	if changed {
+		if err := q.s3Client.PutBucketTagging(bucketName, tags); err != nil {
+			return fmt.Errorf("failed to tag bucket: %w", err)
+		}
+	}
+
+	if len(stripped) > 0 {
+		if len(policy.Statement) == 0 {
+			err = q.s3Client.DeleteBucketPolicy(bucketName)
+		} else {
+			_, err = q.s3Client.PutBucketPolicy(bucketName, *policy)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to strip grants from bucket policy: %w", err)
+		}
+	}
+	klog.InfoS("Quarantined bucket", "bucketName", bucketName, "deletedAt", tags[tagDeletedAt], "grants", len(grants))
+	return nil
+}
+
+// List returns the quarantined buckets of the driver, oldest first.
+// Buckets whose tags cannot be read, such as the buckets of other users, are skipped.
+func (q *Quarantine) List() ([]QuarantinedBucket, error) {
+	names, err := q.s3Client.ListBuckets()
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := []QuarantinedBucket{}
+	for _, name := range names {
+		tags, err := q.s3Client.GetBucketTagging(name)
+		if err != nil {
+			klog.ErrorS(err, "skipping bucket whose tags cannot be read", "bucketName", name)
+			continue
+		}
+		if tags[tagDriver] != q.provisioner {
+			continue
+		}
+		value, ok := tags[tagDeletedAt]
+		if !ok {
+			continue
+		}
+		deletedAt, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			klog.ErrorS(err, "ignoring quarantined bucket with invalid deletion time", "bucketName", name, "deletedAt", value)
+			continue
+		}
+		buckets = append(buckets, QuarantinedBucket{Name: name, DeletedAt: deletedAt})
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].DeletedAt.Before(buckets[j].DeletedAt)
+	})
+	return buckets, nil
+}
+
+// Restore takes a bucket out of quarantine so that the reaper leaves it alone.
+// The grants stripped from its policy are put back, replacing statements with the same Sid.
+func (q *Quarantine) Restore(bucketName string) error {
+	tags, err := q.s3Client.GetBucketTagging(bucketName)
+	if err != nil {
+		return fmt.Errorf("failed to fetch bucket tags: %w", err)
+	}
+	if _, ok := tags[tagDeletedAt]; !ok || tags[tagDriver] != q.provisioner {
+		return fmt.Errorf("bucket %q is not quarantined by driver %q", bucketName, q.provisioner)
+	}
+
+	// the grants are put back before their record is removed, so that a failed restore can be retried
+	grants, err := quarantinedGrants(tags)
+	if err != nil {
+		return err
+	}
+	if len(grants) > 0 {
+		policy, err := q.s3Client.GetBucketPolicy(bucketName)
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != s3cli.ErrNoSuchBucketPolicy {
+				return fmt.Errorf("failed to fetch bucket policy: %w", err)
+			}
+			policy = s3cli.NewBucketPolicy()
+		}
+		if _, err := q.s3Client.PutBucketPolicy(bucketName, *policy.ModifyBucketPolicy(grants...)); err != nil {
+			return fmt.Errorf("failed to restore grants to bucket policy: %w", err)
+		}
+	}
+
+	delete(tags, tagDeletedAt)
+	clearQuarantinedGrants(tags)
+	if len(tags) == 0 {
+		err = q.s3Client.DeleteBucketTagging(bucketName)
+	} else {
+		err = q.s3Client.PutBucketTagging(bucketName, tags)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to untag bucket: %w", err)
+	}
+	klog.InfoS("Restored quarantined bucket", "bucketName", bucketName, "grants", len(grants))
+	return nil
+}
+
+// Reap purges and deletes the quarantined buckets whose grace period is over
+func (q *Quarantine) Reap() error {
+	buckets, err := q.List()
+	if err != nil {
+		return err
+	}
+
+	for _, b := range buckets {
+		if time.Since(b.DeletedAt) < q.gracePeriod {
+			// buckets are sorted, all remaining ones are younger
+			break
+		}
+		klog.InfoS("Reaping quarantined bucket", "bucketName", b.Name, "deletedAt", b.DeletedAt)
+		if err := q.s3Client.PurgeBucket(b.Name); err != nil {
+			klog.ErrorS(err, "failed to purge quarantined bucket", "bucketName", b.Name)
+			continue
+		}
+		if _, err := q.s3Client.DeleteBucket(b.Name); err != nil {
+			klog.ErrorS(err, "failed to delete quarantined bucket", "bucketName", b.Name)
+			continue
+		}
+		klog.InfoS("Successfully reaped quarantined bucket", "bucketName", b.Name)
+	}
+	return nil
+}
+
+// Run reaps expired buckets periodically until ctx is cancelled
+func (q *Quarantine) Run(ctx context.Context) {
+	ticker := time.NewTicker(quarantineReapInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := q.Reap(); err != nil {
+			klog.ErrorS(err, "failed to reap quarantined buckets")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// setQuarantinedGrants records the statements in the tags, replacing any earlier record.
+// The record is gzipped json, base64 encoded to fit the characters allowed in tag values.
+func setQuarantinedGrants(tags map[string]string, statements []s3cli.PolicyStatement) error {
+	data, err := json.Marshal(statements)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	clearQuarantinedGrants(tags)
+	for i := 0; len(encoded) > 0; i++ {
+		n := min(len(encoded), maxTagValueLength)
+		tags[tagGrantsPrefix+strconv.Itoa(i)] = encoded[:n]
+		encoded = encoded[n:]
+	}
+	if len(tags) > maxTags {
+		return fmt.Errorf("%d tags would be needed, at most %d are allowed", len(tags), maxTags)
+	}
+	return nil
+}
+
+// quarantinedGrants returns the statements recorded by setQuarantinedGrants, if any
+func quarantinedGrants(tags map[string]string) ([]s3cli.PolicyStatement, error) {
+	var encoded strings.Builder
+	for i := 0; ; i++ {
+		chunk, ok := tags[tagGrantsPrefix+strconv.Itoa(i)]
+		if !ok {
+			break
+		}
+		encoded.WriteString(chunk)
+	}
+	if encoded.Len() == 0 {
+		return nil, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encoded.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid quarantined grants: %w", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid quarantined grants: %w", err)
+	}
+	data, err = io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid quarantined grants: %w", err)
+	}
+	statements := []s3cli.PolicyStatement{}
+	if err := json.Unmarshal(data, &statements); err != nil {
+		return nil, fmt.Errorf("invalid quarantined grants: %w", err)
+	}
+	return statements, nil
+}
+
+// clearQuarantinedGrants removes the record of setQuarantinedGrants from the tags
+func clearQuarantinedGrants(tags map[string]string) {
+	for k := range tags {
+		if strings.HasPrefix(k, tagGrantsPrefix) {
+			delete(tags, k)
+		}
+	}
+}
@@ -0,0 +1,502 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ntnxIam "github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/admin"
+	"github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/util/kube"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	cosiapi "sigs.k8s.io/container-object-storage-interface-api/apis/objectstorage/v1alpha1"
+)
+
+const (
+	// DefaultGrantKeyOverlap is how long the previous access key of a granted user stays valid after a rotation
+	DefaultGrantKeyOverlap = 24 * time.Hour
+	// DefaultRotationStatusAddress is the local address serving the rotation status
+	DefaultRotationStatusAddress = "localhost:8090"
+	// RotationStatusPath is the path of the rotation status endpoint
+	RotationStatusPath = "/rotation"
+	// AcknowledgedKeyAnnotation is set on a BucketAccess by its consumer to the access key ID it switched to,
+	// the previous keys of the grant are deleted once it matches the current key
+	AcknowledgedKeyAnnotation = "ntnx.objectstorage.k8s.io/acknowledged-access-key"
+
+	// grantKeyCheckInterval is how often the age of the granted users keys is checked
+	grantKeyCheckInterval = time.Hour
+	// bucketInfoKey is the key of the BucketAccess Secret holding the credentials, written by the COSI sidecar
+	bucketInfoKey = "BucketInfo"
+)
+
+var (
+	// errGrantNotFound is returned when a rotation is requested for a BucketAccess the driver did not grant
+	errGrantNotFound = errors.New("no granted BucketAccess of this driver")
+	// errNotLoopback is returned for a rotation status address that is reachable from outside the pod
+	errNotLoopback = errors.New("the rotation status endpoint must listen on a loopback address")
+)
+
+// KeyRotationOptions enables the rotation of the access keys of the IAM users created by grants.
+// The COSI spec has no rotation call, the driver writes the new key to the BucketAccess Secret itself:
+// it takes over the Secret written by the sidecar for the grants of the classes opting in with keyRotation.
+type KeyRotationOptions struct {
+	// Interval is the age at which the access key of a granted user is replaced
+	Interval time.Duration
+	// Overlap is how long the previous key stays valid after a rotation at least, so that apps pick up the new one.
+	// DefaultGrantKeyOverlap is used when it is 0.
+	Overlap time.Duration
+	// DeleteRetiredKeys deletes the previous key once the overlap is over. Otherwise the previous key is only
+	// deleted once the consumer acknowledged the new one through the AcknowledgedKeyAnnotation of the BucketAccess.
+	DeleteRetiredKeys bool
+	// StatusAddress is the loopback address of the rotation status endpoint, "" disables it
+	StatusAddress string
+}
+
+// GrantKeyStatus is the rotation state of the access keys of a granted user
+type GrantKeyStatus struct {
+	// BucketAccess is the BucketAccess of the grant, "<namespace>/<name>"
+	BucketAccess string `json:"bucketAccess"`
+	// AccountID is the account ID of the grant, the username of its IAM user or the UUID for earlier grants
+	AccountID string `json:"accountID"`
+	// ObjectStore is the object store of the IAM user, "" for the object store of the driver flags
+	ObjectStore string `json:"objectStore,omitempty"`
+	// AccessKeyID is the access key in the BucketAccess Secret
+	AccessKeyID  string    `json:"accessKeyID,omitempty"`
+	KeyCreatedAt time.Time `json:"keyCreatedAt"`
+	NextRotation time.Time `json:"nextRotation"`
+	// AgeUnknown is set when Prism Central reports no creation time for the current key. Such a key is only
+	// replaced by a requested rotation and its previous keys only retire once the new key is acknowledged.
+	AgeUnknown bool `json:"ageUnknown,omitempty"`
+	// RetiringKeys are the previous access keys, deleted once the overlap window is over or the new key is acknowledged
+	RetiringKeys []string `json:"retiringKeys,omitempty"`
+	// AwaitingAcknowledgement is set while the retiring keys wait for the consumer to acknowledge the current key,
+	// the next rotation is postponed until then
+	AwaitingAcknowledgement bool      `json:"awaitingAcknowledgement,omitempty"`
+	LastRotation            time.Time `json:"lastRotation"`
+	Error                   string    `json:"error,omitempty"`
+}
+
+// RotationStatus is the document served by the rotation status endpoint
+type RotationStatus struct {
+	LastRun time.Time        `json:"lastRun"`
+	Grants  []GrantKeyStatus `json:"grants"`
+}
+
+// keyRotator rotates the access keys of the IAM users of the BucketAccesses of the driver
+type keyRotator struct {
+	provisioner  string
+	objectStores *objectStoreRegistry
+	kube         *kube.Clients
+	opts         KeyRotationOptions
+
+	// runMu serializes the periodic and the requested rotations
+	runMu sync.Mutex
+
+	mu      sync.RWMutex
+	lastRun time.Time
+	// status is the state of each grant by BucketAccess, as of the last run
+	status map[string]GrantKeyStatus
+}
+
+func newKeyRotator(provisioner string, objectStores *objectStoreRegistry, clients *kube.Clients, opts KeyRotationOptions) (*keyRotator, error) {
+	if opts.Overlap == 0 {
+		opts.Overlap = DefaultGrantKeyOverlap
+	}
+	if opts.Overlap >= opts.Interval {
+		return nil, fmt.Errorf("key overlap %s must be shorter than the rotation interval %s", opts.Overlap, opts.Interval)
+	}
+	if opts.StatusAddress != "" {
+		if err := validateStatusAddress(opts.StatusAddress); err != nil {
+			return nil, err
+		}
+	}
+	return &keyRotator{
+		provisioner:  provisioner,
+		objectStores: objectStores,
+		kube:         clients,
+		opts:         opts,
+		status:       map[string]GrantKeyStatus{},
+	}, nil
+}
+
+// validateStatusAddress accepts host:port addresses whose host is localhost or a loopback IP,
+// the endpoint has no authentication so it must only be reachable from within the pod
+func validateStatusAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid rotation status address %q: %w", address, err)
+	}
+	if !isLoopback(host) {
+		return fmt.Errorf("%w, got %q", errNotLoopback, address)
+	}
+	return nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// run checks the keys of every grant until ctx is done
+func (r *keyRotator) run(ctx context.Context) {
+	ticker := time.NewTicker(min(grantKeyCheckInterval, r.opts.Interval))
+	defer ticker.Stop()
+
+	for {
+		if _, err := r.rotateAll(ctx, ""); err != nil {
+			klog.ErrorS(err, "failed to rotate access keys of granted users")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// rotateAll checks the keys of the grants of the driver, rotating the keys that are due and deleting
+// the previous keys that may be retired. When force names a BucketAccess, "<namespace>/<name>",
+// only that grant is checked and its key is rotated whatever its age.
+// Only the grants of BucketAccessClasses setting the keyRotation parameter are checked.
+func (r *keyRotator) rotateAll(ctx context.Context, force string) ([]GrantKeyStatus, error) {
+	r.runMu.Lock()
+	defer r.runMu.Unlock()
+
+	classes, err := r.kube.COSI.ObjectstorageV1alpha1().BucketAccessClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list BucketAccessClasses: %w", err)
+	}
+	ours := map[string]bool{}
+	for _, c := range classes.Items {
+		if !strings.EqualFold(c.DriverName, r.provisioner) {
+			continue
+		}
+		params, err := parseAccessParameters(c.Parameters)
+		if err != nil {
+			klog.ErrorS(err, "skipping BucketAccessClass with invalid parameters", "name", c.Name)
+			continue
+		}
+		ours[c.Name] = params.keyRotation
+	}
+
+	accesses, err := r.kube.COSI.ObjectstorageV1alpha1().BucketAccesses(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list BucketAccesses: %w", err)
+	}
+
+	var results []GrantKeyStatus
+	for _, ba := range accesses.Items {
+		if !ours[ba.Spec.BucketAccessClassName] || !ba.Status.AccessGranted || ba.Status.AccountID == "" {
+			continue
+		}
+		name := ba.Namespace + "/" + ba.Name
+		if force != "" && name != force {
+			continue
+		}
+
+		r.mu.RLock()
+		st := r.status[name]
+		r.mu.RUnlock()
+		st = r.rotate(ctx, &ba, st, force != "")
+		if st.Error != "" {
+			klog.ErrorS(errors.New(st.Error), "failed to rotate access key", "bucketAccess", name, "id", st.AccountID)
+		}
+		results = append(results, st)
+	}
+	if force != "" && len(results) == 0 {
+		return nil, fmt.Errorf("%w: %q", errGrantNotFound, force)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if force == "" {
+		// grants that are gone are dropped from the status
+		r.status = map[string]GrantKeyStatus{}
+		r.lastRun = time.Now()
+	}
+	for _, st := range results {
+		r.status[st.BucketAccess] = st
+	}
+	return results, nil
+}
+
+// rotate checks the keys of the IAM user of a grant. previous is the status of the last run.
+func (r *keyRotator) rotate(ctx context.Context, ba *cosiapi.BucketAccess, previous GrantKeyStatus, force bool) GrantKeyStatus {
+	st := GrantKeyStatus{
+		BucketAccess: ba.Namespace + "/" + ba.Name,
+		AccountID:    ba.Status.AccountID,
+		LastRotation: previous.LastRotation,
+	}
+	fail := func(err error) GrantKeyStatus {
+		st.Error = err.Error()
+		return st
+	}
+
+	store, userID, keys, err := r.userKeys(ctx, ba)
+	if err != nil {
+		return fail(err)
+	}
+	st.ObjectStore = store.name
+
+	secret, err := r.kube.Core.CoreV1().Secrets(ba.Namespace).Get(ctx, ba.Spec.CredentialsSecretName, metav1.GetOptions{})
+	if err != nil {
+		return fail(fmt.Errorf("failed to read secret %s: %w", ba.Spec.CredentialsSecretName, err))
+	}
+	bucketInfo, err := parseBucketInfo(secret.Data[bucketInfoKey])
+	if err != nil {
+		return fail(fmt.Errorf("invalid secret %s: %w", ba.Spec.CredentialsSecretName, err))
+	}
+
+	current, retiring, err := selectKeys(keys, bucketInfo.accessKeyID())
+	if err != nil {
+		return fail(fmt.Errorf("secret %s: %w", ba.Spec.CredentialsSecretName, err))
+	}
+
+	if len(retiring) > 0 && r.retirable(current, ba.Annotations[AcknowledgedKeyAnnotation], time.Now()) {
+		for _, k := range retiring {
+			if err := store.ntnxIamClient.DeleteAccessKey(ctx, userID, k.AccessKeyID); err != nil {
+				st.RetiringKeys = keyIDs(retiring)
+				return fail(fmt.Errorf("failed to delete previous access key %q: %w", k.AccessKeyID, err))
+			}
+			klog.InfoS("Deleted previous access key", "bucketAccess", st.BucketAccess, "id", st.AccountID, "accessKeyID", k.AccessKeyID)
+		}
+		retiring = nil
+	}
+
+	// a new key is only added once the previous ones are retired, unless the rotation is forced after a leak
+	if force || (r.due(current, time.Now()) && len(retiring) == 0) {
+		key, err := r.replaceKey(ctx, store, userID, ba, bucketInfo)
+		if err != nil {
+			return fail(err)
+		}
+		retiring = append(retiring, current)
+		current = key
+		st.LastRotation = time.Now()
+		klog.InfoS("Rotated access key", "bucketAccess", st.BucketAccess, "id", st.AccountID, "accessKeyID", key.AccessKeyID)
+	}
+	st.AccessKeyID = current.AccessKeyID
+	if current.CreatedTime.IsZero() {
+		st.AgeUnknown = true
+	} else {
+		st.KeyCreatedAt = current.CreatedTime
+		st.NextRotation = current.CreatedTime.Add(r.opts.Interval)
+	}
+	st.RetiringKeys = keyIDs(retiring)
+	st.AwaitingAcknowledgement = len(retiring) > 0 && !r.opts.DeleteRetiredKeys
+	return st
+}
+
+// selectKeys sorts the access keys of the user of a grant into the current key, the one of the
+// BucketAccess Secret, and the retiring keys, all the others
+func selectKeys(keys []ntnxIam.BucketsAccessKey, currentID string) (ntnxIam.BucketsAccessKey, []ntnxIam.BucketsAccessKey, error) {
+	var current *ntnxIam.BucketsAccessKey
+	var retiring []ntnxIam.BucketsAccessKey
+	for i := range keys {
+		if keys[i].AccessKeyID == currentID {
+			current = &keys[i]
+			continue
+		}
+		retiring = append(retiring, keys[i])
+	}
+	if current == nil {
+		return ntnxIam.BucketsAccessKey{}, nil, fmt.Errorf("access key %q is not a key of the user", currentID)
+	}
+	return *current, retiring, nil
+}
+
+// due reports whether key is old enough to be replaced. A key without creation time is never due,
+// rotating it on every check would replace the key of the grant each hour.
+func (r *keyRotator) due(key ntnxIam.BucketsAccessKey, now time.Time) bool {
+	return !key.CreatedTime.IsZero() && now.Sub(key.CreatedTime) >= r.opts.Interval
+}
+
+// retirable reports whether the keys replaced by current may be deleted: right away once the consumer
+// acknowledged current, or after the overlap window when the driver deletes retired keys by itself.
+// The overlap of a current key without creation time cannot be measured, only an acknowledgement retires its previous keys.
+func (r *keyRotator) retirable(current ntnxIam.BucketsAccessKey, acknowledged string, now time.Time) bool {
+	if acknowledged == current.AccessKeyID {
+		return true
+	}
+	return r.opts.DeleteRetiredKeys && !current.CreatedTime.IsZero() && now.Sub(current.CreatedTime) >= r.opts.Overlap
+}
+
+func keyIDs(keys []ntnxIam.BucketsAccessKey) []string {
+	ids := make([]string, 0, len(keys))
+	for _, k := range keys {
+		ids = append(ids, k.AccessKeyID)
+	}
+	return ids
+}
+
+// userKeys returns the object store of the bucket of a grant and the UUID of the IAM user of its
+// account ID, along with its access keys. The user is only looked up on the object store of the bucket,
+// usernames are not unique across object stores.
+func (r *keyRotator) userKeys(ctx context.Context, ba *cosiapi.BucketAccess) (*objectStore, string, []ntnxIam.BucketsAccessKey, error) {
+	store, err := r.objectStores.forBucketAccess(ctx, r.kube.COSI, ba)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	user, err := store.accountUser(ctx, ba.Status.AccountID)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to look up user: %w", err)
+	}
+	keys, err := store.ntnxIamClient.ListAccessKeys(ctx, user.UUID)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to list access keys: %w", err)
+	}
+	return store, user.UUID, keys, nil
+}
+
+// replaceKey creates a new access key for the user of a grant and writes it to the BucketAccess Secret.
+// The new key is deleted again when the Secret cannot be updated, so that the user never has a key no one knows.
+func (r *keyRotator) replaceKey(ctx context.Context, store *objectStore, userID string, ba *cosiapi.BucketAccess, bucketInfo bucketInfo) (ntnxIam.BucketsAccessKey, error) {
+	key, err := store.ntnxIamClient.CreateAccessKey(ctx, userID)
+	if err != nil {
+		return key, fmt.Errorf("failed to create access key: %w", err)
+	}
+	if key.CreatedTime.IsZero() {
+		key.CreatedTime = time.Now()
+	}
+
+	data, err := bucketInfo.withKey(key)
+	if err == nil {
+		err = kube.UpdateSecretData(ctx, r.kube.Core, ba.Namespace, ba.Spec.CredentialsSecretName, map[string][]byte{bucketInfoKey: data}, false)
+	}
+	if err != nil {
+		if err := store.ntnxIamClient.DeleteAccessKey(ctx, userID, key.AccessKeyID); err != nil {
+			klog.ErrorS(err, "failed to delete unused access key", "id", userID, "accessKeyID", key.AccessKeyID)
+		}
+		return key, fmt.Errorf("failed to update secret %s: %w", ba.Spec.CredentialsSecretName, err)
+	}
+	return key, nil
+}
+
+// bucketInfo is the BucketInfo document the COSI sidecar writes to the BucketAccess Secret.
+// It is kept as a generic document, so that the fields the driver does not know survive an update.
+type bucketInfo map[string]interface{}
+
+func parseBucketInfo(data []byte) (bucketInfo, error) {
+	info := bucketInfo{}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", bucketInfoKey, err)
+	}
+	if info.secretS3() == nil {
+		return nil, fmt.Errorf("%s holds no S3 credentials", bucketInfoKey)
+	}
+	return info, nil
+}
+
+func (b bucketInfo) secretS3() map[string]interface{} {
+	spec, _ := b["spec"].(map[string]interface{})
+	s3, _ := spec["secretS3"].(map[string]interface{})
+	return s3
+}
+
+func (b bucketInfo) accessKeyID() string {
+	id, _ := b.secretS3()["accessKeyID"].(string)
+	return id
+}
+
+// withKey returns the document with the given access key
+func (b bucketInfo) withKey(key ntnxIam.BucketsAccessKey) ([]byte, error) {
+	s3 := b.secretS3()
+	s3["accessKeyID"] = key.AccessKeyID
+	s3["accessSecretKey"] = key.SecretAccessKey
+	return json.Marshal(b)
+}
+
+// serveStatus serves the rotation status on opts.StatusAddress, a loopback address, until ctx is done.
+// GET returns the status of every grant, POST with the bucketAccess query parameter
+// rotates the key of that grant right away.
+func (r *keyRotator) serveStatus(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(RotationStatusPath, r.handleStatus)
+	server := &http.Server{
+		Addr:              r.opts.StatusAddress,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	klog.InfoS("Serving key rotation status", "address", r.opts.StatusAddress)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		klog.ErrorS(err, "key rotation status endpoint failed", "address", r.opts.StatusAddress)
+	}
+}
+
+func (r *keyRotator) handleStatus(w http.ResponseWriter, req *http.Request) {
+	// the listener is bound to a loopback address, requests relayed from elsewhere are refused all the same
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err != nil || !isLoopback(host) {
+		http.Error(w, "the rotation status is only served to local clients", http.StatusForbidden)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		r.mu.RLock()
+		status := RotationStatus{LastRun: r.lastRun, Grants: make([]GrantKeyStatus, 0, len(r.status))}
+		for _, st := range r.status {
+			status.Grants = append(status.Grants, st)
+		}
+		r.mu.RUnlock()
+		sort.Slice(status.Grants, func(i, j int) bool {
+			return status.Grants[i].BucketAccess < status.Grants[j].BucketAccess
+		})
+		writeJSON(w, http.StatusOK, status)
+	case http.MethodPost:
+		bucketAccess := req.URL.Query().Get("bucketAccess")
+		if bucketAccess == "" {
+			http.Error(w, "bucketAccess query parameter, <namespace>/<name>, is required", http.StatusBadRequest)
+			return
+		}
+		results, err := r.rotateAll(req.Context(), bucketAccess)
+		switch {
+		case errors.Is(err, errGrantNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, http.StatusOK, results[0])
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		klog.ErrorS(err, "failed to write rotation status")
+	}
+}
@@ -0,0 +1,282 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	ntnxIam "github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/admin"
+	"github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/util/kube"
+	"k8s.io/client-go/kubernetes/fake"
+	cosifake "sigs.k8s.io/container-object-storage-interface-api/client/clientset/versioned/fake"
+)
+
+func TestSelectKeys(t *testing.T) {
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := ntnxIam.BucketsAccessKey{AccessKeyID: "a", CreatedTime: created}
+	b := ntnxIam.BucketsAccessKey{AccessKeyID: "b", CreatedTime: created.Add(time.Hour)}
+	c := ntnxIam.BucketsAccessKey{AccessKeyID: "c", CreatedTime: created.Add(2 * time.Hour)}
+
+	tests := []struct {
+		name         string
+		keys         []ntnxIam.BucketsAccessKey
+		currentID    string
+		wantCurrent  string
+		wantRetiring []string
+		wantErr      bool
+	}{
+		{name: "single key", keys: []ntnxIam.BucketsAccessKey{a}, currentID: "a", wantCurrent: "a"},
+		{name: "previous keys retire", keys: []ntnxIam.BucketsAccessKey{a, b, c}, currentID: "c", wantCurrent: "c", wantRetiring: []string{"a", "b"}},
+		{name: "secret holds an older key", keys: []ntnxIam.BucketsAccessKey{a, b}, currentID: "a", wantCurrent: "a", wantRetiring: []string{"b"}},
+		{name: "secret key is not a key of the user", keys: []ntnxIam.BucketsAccessKey{a, b}, currentID: "x", wantErr: true},
+		{name: "no keys", currentID: "a", wantErr: true},
+		{name: "no creation time", keys: []ntnxIam.BucketsAccessKey{{AccessKeyID: "a"}, b}, currentID: "a", wantCurrent: "a", wantRetiring: []string{"b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current, retiring, err := selectKeys(tt.keys, tt.currentID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if current.AccessKeyID != tt.wantCurrent {
+				t.Errorf("current = %q, want %q", current.AccessKeyID, tt.wantCurrent)
+			}
+			if got := keyIDs(retiring); !reflect.DeepEqual(got, append([]string{}, tt.wantRetiring...)) {
+				t.Errorf("retiring = %v, want %v", got, tt.wantRetiring)
+			}
+		})
+	}
+}
+
+func TestRetirable(t *testing.T) {
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	overlap := 24 * time.Hour
+
+	tests := []struct {
+		name          string
+		deleteRetired bool
+		age           time.Duration
+		acknowledged  string
+		want          bool
+	}{
+		{name: "acknowledged within the overlap", age: time.Hour, acknowledged: "current", want: true},
+		{name: "acknowledged after the overlap", age: 2 * overlap, acknowledged: "current", want: true},
+		{name: "previous key acknowledged", age: 2 * overlap, acknowledged: "previous", want: false},
+		{name: "not acknowledged", age: 2 * overlap, want: false},
+		{name: "deleted by the driver within the overlap", deleteRetired: true, age: overlap - time.Second, want: false},
+		{name: "deleted by the driver when the overlap ends", deleteRetired: true, age: overlap, want: true},
+		{name: "deleted by the driver after the overlap", deleteRetired: true, age: 2 * overlap, want: true},
+		{name: "age unknown", deleteRetired: true, age: -1, want: false},
+		{name: "age unknown and acknowledged", deleteRetired: true, age: -1, acknowledged: "current", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &keyRotator{opts: KeyRotationOptions{Interval: 90 * overlap, Overlap: overlap, DeleteRetiredKeys: tt.deleteRetired}}
+			current := ntnxIam.BucketsAccessKey{AccessKeyID: "current", CreatedTime: now.Add(-tt.age)}
+			if tt.age < 0 {
+				current.CreatedTime = time.Time{}
+			}
+			if got := r.retirable(current, tt.acknowledged, now); got != tt.want {
+				t.Errorf("retirable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDue(t *testing.T) {
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	r := &keyRotator{opts: KeyRotationOptions{Interval: 30 * 24 * time.Hour}}
+
+	if r.due(ntnxIam.BucketsAccessKey{CreatedTime: now.Add(-r.opts.Interval + time.Second)}, now) {
+		t.Error("due() = true for a key younger than the interval")
+	}
+	if !r.due(ntnxIam.BucketsAccessKey{CreatedTime: now.Add(-r.opts.Interval)}, now) {
+		t.Error("due() = false for a key as old as the interval")
+	}
+	// a key of unknown age is left to requested rotations
+	if r.due(ntnxIam.BucketsAccessKey{}, now) {
+		t.Error("due() = true for a key without creation time")
+	}
+}
+
+func TestParseBucketInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantKey string
+		wantErr bool
+	}{
+		{
+			name:    "sidecar document",
+			data:    `{"metadata":{"name":"ba-1"},"spec":{"bucketName":"b","authenticationType":"Key","secretS3":{"endpoint":"https://s3","region":"us-east-1","accessKeyID":"AK","accessSecretKey":"SK"},"secretAzure":null,"protocols":["s3"]}}`,
+			wantKey: "AK",
+		},
+		{name: "no S3 credentials", data: `{"spec":{"bucketName":"b","secretS3":null}}`, wantErr: true},
+		{name: "no spec", data: `{}`, wantErr: true},
+		{name: "not json", data: `BucketInfo`, wantErr: true},
+		{name: "empty", data: ``, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := parseBucketInfo([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBucketInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && info.accessKeyID() != tt.wantKey {
+				t.Errorf("accessKeyID() = %q, want %q", info.accessKeyID(), tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestBucketInfoWithKey(t *testing.T) {
+	data := `{"metadata":{"name":"ba-1","uid":"u"},"spec":{"bucketName":"b","authenticationType":"Key","secretS3":{"endpoint":"https://s3","region":"us-east-1","accessKeyID":"AK","accessSecretKey":"SK","caBundle":"pem"},"protocols":["s3"],"future":{"x":1}}}`
+	info, err := parseBucketInfo([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := info.withKey(ntnxIam.BucketsAccessKey{AccessKeyID: "AK2", SecretAccessKey: "SK2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]interface{}{}
+	if err := json.Unmarshal(updated, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(data), &want); err != nil {
+		t.Fatal(err)
+	}
+	// only the key changes, the fields unknown to the driver are kept
+	s3 := want["spec"].(map[string]interface{})["secretS3"].(map[string]interface{})
+	s3["accessKeyID"] = "AK2"
+	s3["accessSecretKey"] = "SK2"
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("withKey() = %s, want %v", updated, want)
+	}
+}
+
+func TestValidateStatusAddress(t *testing.T) {
+	tests := []struct {
+		address      string
+		wantLoopback bool
+		wantErr      bool
+	}{
+		{address: "localhost:8090"},
+		{address: "127.0.0.1:8090"},
+		{address: "127.0.0.2:8090"},
+		{address: "[::1]:8090"},
+		{address: ":8090", wantErr: true, wantLoopback: true},
+		{address: "0.0.0.0:8090", wantErr: true, wantLoopback: true},
+		{address: "10.0.0.1:8090", wantErr: true, wantLoopback: true},
+		{address: "[::]:8090", wantErr: true, wantLoopback: true},
+		{address: "example.com:8090", wantErr: true, wantLoopback: true},
+		{address: "localhost", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := validateStatusAddress(tt.address)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateStatusAddress() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantLoopback && !errors.Is(err, errNotLoopback) {
+				t.Errorf("validateStatusAddress() error = %v, want %v", err, errNotLoopback)
+			}
+		})
+	}
+}
+
+func TestNewKeyRotatorRejectsPublicStatusAddress(t *testing.T) {
+	_, err := newKeyRotator("ntnx", nil, nil, KeyRotationOptions{Interval: 90 * 24 * time.Hour, StatusAddress: ":8090"})
+	if !errors.Is(err, errNotLoopback) {
+		t.Errorf("newKeyRotator() error = %v, want %v", err, errNotLoopback)
+	}
+}
+
+func TestHandleStatus(t *testing.T) {
+	lastRun := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newRotator := func() *keyRotator {
+		return &keyRotator{
+			provisioner: "ntnx.objectstorage.k8s.io",
+			kube:        &kube.Clients{Core: fake.NewSimpleClientset(), COSI: cosifake.NewSimpleClientset()},
+			opts:        KeyRotationOptions{Interval: 90 * 24 * time.Hour, Overlap: 24 * time.Hour},
+			lastRun:     lastRun,
+			status: map[string]GrantKeyStatus{
+				"ns-b/ba": {BucketAccess: "ns-b/ba", AccountID: "user-b", AccessKeyID: "AK-B"},
+				"ns-a/ba": {BucketAccess: "ns-a/ba", AccountID: "user-a", AccessKeyID: "AK-A", RetiringKeys: []string{"AK-0"}, AwaitingAcknowledgement: true},
+			},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		remoteAddr string
+		wantCode   int
+	}{
+		{name: "status", method: http.MethodGet, target: RotationStatusPath, remoteAddr: "127.0.0.1:40000", wantCode: http.StatusOK},
+		{name: "status over IPv6 loopback", method: http.MethodGet, target: RotationStatusPath, remoteAddr: "[::1]:40000", wantCode: http.StatusOK},
+		{name: "remote client", method: http.MethodGet, target: RotationStatusPath, remoteAddr: "10.0.0.8:40000", wantCode: http.StatusForbidden},
+		{name: "remote rotation", method: http.MethodPost, target: RotationStatusPath + "?bucketAccess=ns-a/ba", remoteAddr: "10.0.0.8:40000", wantCode: http.StatusForbidden},
+		{name: "rotation without bucket access", method: http.MethodPost, target: RotationStatusPath, remoteAddr: "127.0.0.1:40000", wantCode: http.StatusBadRequest},
+		{name: "rotation of an unknown bucket access", method: http.MethodPost, target: RotationStatusPath + "?bucketAccess=ns-c/ba", remoteAddr: "127.0.0.1:40000", wantCode: http.StatusNotFound},
+		{name: "other method", method: http.MethodDelete, target: RotationStatusPath, remoteAddr: "127.0.0.1:40000", wantCode: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			req.RemoteAddr = tt.remoteAddr
+			rec := httptest.NewRecorder()
+			newRotator().handleStatus(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status code = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body.String())
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			status := RotationStatus{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+				t.Fatal(err)
+			}
+			if !status.LastRun.Equal(lastRun) {
+				t.Errorf("lastRun = %s, want %s", status.LastRun, lastRun)
+			}
+			var names []string
+			for _, g := range status.Grants {
+				names = append(names, g.BucketAccess)
+			}
+			if want := []string{"ns-a/ba", "ns-b/ba"}; !reflect.DeepEqual(names, want) {
+				t.Errorf("grants = %v, want %v sorted by BucketAccess", names, want)
+			}
+			if g := status.Grants[0]; !g.AwaitingAcknowledgement || !reflect.DeepEqual(g.RetiringKeys, []string{"AK-0"}) {
+				t.Errorf("grant %s = %+v, want the retiring key awaiting acknowledgement", g.BucketAccess, g)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// rollbackTimeout bounds the time spent undoing the steps of a failed operation.
+	// Rollback does not use the request context, which is often what expired.
+	rollbackTimeout = 30 * time.Second
+
+	// reasonRollbackFailed is the ErrorInfo reason reported when a step could not be undone
+	reasonRollbackFailed = "ROLLBACK_FAILED"
+)
+
+// sagaStep is a completed step of an operation along with the function undoing it
+type sagaStep struct {
+	name string
+	undo func(ctx context.Context) error
+}
+
+// saga records the completed steps of a multi step operation, so that they can be
+// undone in reverse order when a later step fails.
+type saga struct {
+	// operation names the operation in logs
+	operation string
+	// domain is the ErrorInfo domain of rollback failures, the driver name
+	domain string
+	steps  []sagaStep
+}
+
+func newSaga(domain, operation string) *saga {
+	return &saga{
+		operation: operation,
+		domain:    domain,
+	}
+}
+
+// done records that a step completed, undo reverts it if the operation is aborted
+func (s *saga) done(step string, undo func(ctx context.Context) error) {
+	s.steps = append(s.steps, sagaStep{name: step, undo: undo})
+}
+
+// abort undoes the completed steps in reverse order and returns the gRPC status error
+// translating cause, the error that failed the operation. Steps that could not be undone are
+// reported in an additional ErrorInfo detail mapping the step name to the rollback error,
+// they are left for an administrator to clean up.
+func (s *saga) abort(cause error, msg string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+
+	failures := map[string]string{}
+	for i := len(s.steps) - 1; i >= 0; i-- {
+		step := s.steps[i]
+		klog.InfoS("Rolling back step", "operation", s.operation, "step", step.name)
+		if err := step.undo(ctx); err != nil {
+			klog.ErrorS(err, "failed to roll back step", "operation", s.operation, "step", step.name)
+			failures[step.name] = err.Error()
+		}
+	}
+	s.steps = nil
+
+	if len(failures) == 0 {
+		return toStatus(s.domain, cause, msg).Err()
+	}
+	st := toStatus(s.domain, cause, msg+", rollback incomplete")
+	detailed, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   reasonRollbackFailed,
+		Domain:   s.domain,
+		Metadata: failures,
+	})
+	if err != nil {
+		klog.ErrorS(err, "failed to attach rollback failures to status", "operation", s.operation)
+		return st.Err()
+	}
+	return detailed.Err()
+}
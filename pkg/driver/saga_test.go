@@ -0,0 +1,109 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// grantSaga records the steps of a grant, the undo of the steps in failing returns an error.
+// The names of the undone steps are appended to undone.
+func grantSaga(t *testing.T, undone *[]string, failing ...string) *saga {
+	tx := newSaga(testProvisioner, "grant bucket access")
+	for _, step := range []string{"create user", "create access key", "set policy"} {
+		var undoErr error
+		for _, f := range failing {
+			if f == step {
+				undoErr = errors.New("undo " + step + " failed")
+			}
+		}
+		tx.done(step, func(ctx context.Context) error {
+			if _, ok := ctx.Deadline(); !ok {
+				t.Errorf("undo of %q has no deadline", step)
+			}
+			*undone = append(*undone, step)
+			return undoErr
+		})
+	}
+	return tx
+}
+
+// rollbackFailures returns the metadata of the rollback failure detail of err
+func rollbackFailures(err error) map[string]string {
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Reason == reasonRollbackFailed {
+			return info.Metadata
+		}
+	}
+	return nil
+}
+
+func TestSagaAbort(t *testing.T) {
+	var undone []string
+	err := grantSaga(t, &undone).abort(awserr.New("AccessDenied", "Access Denied", nil), "failed to set policy")
+
+	if want := []string{"set policy", "create access key", "create user"}; !reflect.DeepEqual(undone, want) {
+		t.Errorf("undone = %v, want %v", undone, want)
+	}
+	// the status translates the cause, not the rollback
+	st := status.Convert(err)
+	if st.Code() != codes.PermissionDenied || st.Message() != "failed to set policy: AccessDenied: Access Denied" {
+		t.Errorf("abort() = %v, want the PermissionDenied status of the cause", err)
+	}
+	if failures := rollbackFailures(err); failures != nil {
+		t.Errorf("rollback failures = %v, want none", failures)
+	}
+}
+
+func TestSagaAbortIncomplete(t *testing.T) {
+	var undone []string
+	err := grantSaga(t, &undone, "create user", "set policy").abort(errors.New("timeout"), "failed to set policy")
+
+	// a failed undo does not stop the rollback of the earlier steps
+	if len(undone) != 3 {
+		t.Errorf("undone = %v, want every step", undone)
+	}
+	if msg := status.Convert(err).Message(); !strings.HasPrefix(msg, "failed to set policy, rollback incomplete") {
+		t.Errorf("message = %q, want the rollback reported incomplete", msg)
+	}
+	want := map[string]string{
+		"create user": "undo create user failed",
+		"set policy":  "undo set policy failed",
+	}
+	if failures := rollbackFailures(err); !reflect.DeepEqual(failures, want) {
+		t.Errorf("rollback failures = %v, want %v", failures, want)
+	}
+}
+
+func TestSagaAbortForgetsSteps(t *testing.T) {
+	var undone []string
+	tx := grantSaga(t, &undone)
+	tx.abort(errors.New("failed"), "first")
+	tx.abort(errors.New("failed"), "second")
+	if len(undone) != 3 {
+		t.Errorf("undone = %v, want each step undone once", undone)
+	}
+}
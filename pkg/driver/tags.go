@@ -0,0 +1,88 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Bucket tags set by the driver to record where a bucket comes from
+const (
+	tagPrefix  = "cosi.objectstorage.k8s.io/"
+	tagDriver  = tagPrefix + "driver"
+	tagCluster = tagPrefix + "cluster"
+
+	// driverTagCount is the number of tags the driver may set on a bucket besides the user defined ones
+	driverTagCount = 2
+
+	// tagParameterPrefix is the BucketClass parameter prefix for user defined bucket tags
+	tagParameterPrefix = "tags."
+
+	maxTags           = 50
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+)
+
+// parseTag validates a user defined bucket tag given as "tags.<key>: <value>"
+func parseTag(p *bucketParameters, key, value string) error {
+	if key == "" || utf8.RuneCountInString(key) > maxTagKeyLength {
+		return fmt.Errorf("tag key must be 1 to %d characters long", maxTagKeyLength)
+	}
+	if utf8.RuneCountInString(value) > maxTagValueLength {
+		return fmt.Errorf("tag value must be at most %d characters long", maxTagValueLength)
+	}
+	if strings.HasPrefix(key, "aws:") || strings.HasPrefix(key, tagPrefix) {
+		return fmt.Errorf("tag keys starting with %q or %q are reserved", "aws:", tagPrefix)
+	}
+	if p.tags == nil {
+		p.tags = make(map[string]string)
+	}
+	p.tags[key] = value
+	return nil
+}
+
+// bucketTags returns the tags the driver sets on a bucket it created
+func (s *ProvisionerServer) bucketTags(params *bucketParameters) map[string]string {
+	tags := map[string]string{
+		tagDriver: s.provisioner,
+	}
+	if s.clusterID != "" {
+		tags[tagCluster] = s.clusterID
+	}
+	for k, v := range params.tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// mergeTags overlays tags on the existing tags of a bucket.
+// It reports whether anything changed and fails when the result exceeds the S3 tag limit.
+func mergeTags(existing, tags map[string]string) (bool, error) {
+	changed := false
+	for k, v := range tags {
+		if old, ok := existing[k]; !ok || old != v {
+			existing[k] = v
+			changed = true
+		}
+	}
+	if len(existing) > maxTags {
+		return false, fmt.Errorf("bucket would carry %d tags, at most %d are allowed", len(existing), maxTags)
+	}
+	return changed, nil
+}
@@ -0,0 +1,49 @@
+// Package kube connects the driver to the API server of the cluster it runs in, authenticated with
+// the service account of the pod, for the Kubernetes resources it reads and writes such as Secrets
+// and BucketAccesses.
+package kube
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	cosiclient "sigs.k8s.io/container-object-storage-interface-api/client/clientset/versioned"
+)
+
+// namespaceFile holds the namespace of the pod service account
+const namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// Clients are the clients of the core and COSI resources
+type Clients struct {
+	Core kubernetes.Interface
+	COSI cosiclient.Interface
+}
+
+// NewInClusterClients returns the clients of the API server of the cluster the pod runs in
+func NewInClusterClients() (*Clients, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load in-cluster config: %w", err)
+	}
+	core, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+	}
+	cosi, err := cosiclient.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create COSI client: %w", err)
+	}
+	return &Clients{Core: core, COSI: cosi}, nil
+}
+
+// Namespace returns the namespace of the pod
+func Namespace() (string, error) {
+	namespace, err := os.ReadFile(namespaceFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read service account namespace: %w", err)
+	}
+	return string(bytes.TrimSpace(namespace)), nil
+}
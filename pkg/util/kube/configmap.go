@@ -0,0 +1,37 @@
+package kube
+
+import (
+	"context"
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ApplyConfigMapData sets the data of the ConfigMap, creating it with the given owners when it is missing.
+// The ConfigMap is left untouched when it already holds the data.
+func ApplyConfigMapData(ctx context.Context, client kubernetes.Interface, namespace, name string, data map[string]string,
+	owners ...metav1.OwnerReference) error {
+	configMaps := client.CoreV1().ConfigMaps(namespace)
+	configMap, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		configMap = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, OwnerReferences: owners},
+			Data:       data,
+		}
+		_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if reflect.DeepEqual(configMap.Data, data) {
+		return nil
+	}
+	configMap.Data = data
+	_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,39 @@
+package kube
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// UpdateSecretData sets the given keys in the data of the Secret, the other keys of the Secret are kept.
+// A missing Secret is created when create is set, otherwise the NotFound error of the API server is returned.
+// The update carries the resourceVersion the Secret was read with, so that concurrent updates are rejected.
+func UpdateSecretData(ctx context.Context, client kubernetes.Interface, namespace, name string, data map[string][]byte, create bool) error {
+	secrets := client.CoreV1().Secrets(namespace)
+	secret, err := secrets.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) && create {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Type:       corev1.SecretTypeOpaque,
+			Data:       data,
+		}
+		_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	for k, v := range data {
+		secret.Data[k] = v
+	}
+	_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	return err
+}
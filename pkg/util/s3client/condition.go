@@ -0,0 +1,92 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package s3client
+
+import (
+	"time"
+)
+
+// ConditionOperator is the operator comparing a condition key to the condition values
+type ConditionOperator string
+
+const (
+	ConditionIPAddress    ConditionOperator = "IpAddress"
+	ConditionNotIPAddress ConditionOperator = "NotIpAddress"
+	ConditionBool         ConditionOperator = "Bool"
+	ConditionStringLike   ConditionOperator = "StringLike"
+	ConditionDateLessThan ConditionOperator = "DateLessThan"
+)
+
+// ConditionKey is the request attribute a condition is evaluated against
+type ConditionKey string
+
+const (
+	KeySourceIP        ConditionKey = "aws:SourceIp"
+	KeySecureTransport ConditionKey = "aws:SecureTransport"
+	KeyCurrentTime     ConditionKey = "aws:CurrentTime"
+	KeyPrefix          ConditionKey = "s3:prefix"
+)
+
+// Condition restricts when a PolicyStatement applies.
+// The condition holds when the Key matches any of the Values according to the Operator.
+type Condition struct {
+	Operator ConditionOperator
+	Key      ConditionKey
+	Values   []string
+}
+
+// SourceIPIn holds for requests sent from one of the given CIDRs
+func SourceIPIn(cidrs ...string) Condition {
+	return Condition{Operator: ConditionIPAddress, Key: KeySourceIP, Values: cidrs}
+}
+
+// SourceIPNotIn holds for requests sent from outside all of the given CIDRs
+func SourceIPNotIn(cidrs ...string) Condition {
+	return Condition{Operator: ConditionNotIPAddress, Key: KeySourceIP, Values: cidrs}
+}
+
+// SecureTransport holds for requests sent over TLS
+func SecureTransport() Condition {
+	return Condition{Operator: ConditionBool, Key: KeySecureTransport, Values: []string{"true"}}
+}
+
+// PrefixLike holds for listings whose prefix matches one of the given patterns, which may use '*' and '?'
+func PrefixLike(patterns ...string) Condition {
+	return Condition{Operator: ConditionStringLike, Key: KeyPrefix, Values: patterns}
+}
+
+// CurrentTimeBefore holds for requests sent before t
+func CurrentTimeBefore(t time.Time) Condition {
+	return Condition{Operator: ConditionDateLessThan, Key: KeyCurrentTime, Values: []string{t.UTC().Format(time.RFC3339)}}
+}
+
+// When adds conditions to the PolicyStatement, the statement only applies when all of them hold
+func (ps *PolicyStatement) When(conditions ...Condition) *PolicyStatement {
+	for _, c := range conditions {
+		if ps.Condition == nil {
+			ps.Condition = ConditionMap{}
+		}
+		operator := string(c.Operator)
+		if ps.Condition[operator] == nil {
+			ps.Condition[operator] = map[string]ConditionValues{}
+		}
+		key := string(c.Key)
+		for _, v := range c.Values {
+			ps.Condition[operator][key] = append(ps.Condition[operator][key], v)
+		}
+	}
+	return ps
+}
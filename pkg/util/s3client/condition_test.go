@@ -0,0 +1,83 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package s3client
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConditionConstructors(t *testing.T) {
+	cet := time.FixedZone("CET", 3600)
+
+	for _, c := range []struct {
+		got  Condition
+		want Condition
+	}{
+		{SourceIPIn("10.0.0.0/8"), Condition{ConditionIPAddress, KeySourceIP, []string{"10.0.0.0/8"}}},
+		{SourceIPNotIn("fd00::/8"), Condition{ConditionNotIPAddress, KeySourceIP, []string{"fd00::/8"}}},
+		{SecureTransport(), Condition{ConditionBool, KeySecureTransport, []string{"true"}}},
+		{PrefixLike("team-a/*"), Condition{ConditionStringLike, KeyPrefix, []string{"team-a/*"}}},
+		// times are written in UTC
+		{CurrentTimeBefore(time.Date(2030, 1, 1, 12, 0, 0, 0, cet)), Condition{ConditionDateLessThan, KeyCurrentTime, []string{"2030-01-01T11:00:00Z"}}},
+	} {
+		if !reflect.DeepEqual(c.got, c.want) {
+			t.Errorf("condition = %+v, want %+v", c.got, c.want)
+		}
+	}
+}
+
+func TestPolicyStatementWhen(t *testing.T) {
+	ps := NewPolicyStatement().
+		When(SourceIPIn("10.0.0.0/8"), SecureTransport()).
+		When(SourceIPIn("192.168.0.0/16"), SourceIPNotIn("10.1.0.0/16"))
+
+	// conditions on the same operator and key are merged into one list of values
+	want := ConditionMap{
+		"IpAddress":    {"aws:SourceIp": {"10.0.0.0/8", "192.168.0.0/16"}},
+		"NotIpAddress": {"aws:SourceIp": {"10.1.0.0/16"}},
+		"Bool":         {"aws:SecureTransport": {"true"}},
+	}
+	if !reflect.DeepEqual(ps.Condition, want) {
+		t.Errorf("Condition = %v, want %v", ps.Condition, want)
+	}
+
+	data, err := json.Marshal(ps.Condition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantJSON := `{"Bool":{"aws:SecureTransport":["true"]},"IpAddress":{"aws:SourceIp":["10.0.0.0/8","192.168.0.0/16"]},"NotIpAddress":{"aws:SourceIp":["10.1.0.0/16"]}}`
+	if string(data) != wantJSON {
+		t.Errorf("Condition = %s, want %s", data, wantJSON)
+	}
+}
+
+func TestPolicyStatementWithoutCondition(t *testing.T) {
+	ps := NewPolicyStatement().When()
+	if ps.Condition != nil {
+		t.Errorf("Condition = %v, want none", ps.Condition)
+	}
+	data, err := json.Marshal(ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "Condition") {
+		t.Errorf("statement = %s, want the Condition element omitted", data)
+	}
+}
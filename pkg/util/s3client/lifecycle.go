@@ -0,0 +1,111 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package s3client
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// DefaultLifecycleRuleID identifies the lifecycle rule managed by the driver.
+// Rules with any other ID are left untouched.
+const DefaultLifecycleRuleID = "cosi-default"
+
+// errNoSuchLifecycleConfiguration is returned by S3 when a bucket has no lifecycle rules
+const errNoSuchLifecycleConfiguration = "NoSuchLifecycleConfiguration"
+
+// LifecycleRules is the declarative form of the bucket wide lifecycle rule managed by the driver.
+// A zero value field leaves the corresponding action unset.
+type LifecycleRules struct {
+	// ExpirationDays expires current object versions after the given number of days
+	ExpirationDays int64 `json:"expirationDays,omitempty" yaml:"expirationDays,omitempty"`
+	// NoncurrentVersionExpirationDays removes noncurrent object versions after the given number of days
+	NoncurrentVersionExpirationDays int64 `json:"noncurrentVersionExpirationDays,omitempty" yaml:"noncurrentVersionExpirationDays,omitempty"`
+	// AbortIncompleteMultipartUploadDays aborts multipart uploads that were not completed within the given number of days
+	AbortIncompleteMultipartUploadDays int64 `json:"abortIncompleteMultipartUploadDays,omitempty" yaml:"abortIncompleteMultipartUploadDays,omitempty"`
+}
+
+// IsEmpty reports whether no lifecycle action is set
+func (r LifecycleRules) IsEmpty() bool {
+	return r == LifecycleRules{}
+}
+
+// rule converts the LifecycleRules into a single S3 lifecycle rule applying to the whole bucket
+func (r LifecycleRules) rule() *s3.LifecycleRule {
+	rule := &s3.LifecycleRule{
+		ID:     aws.String(DefaultLifecycleRuleID),
+		Status: aws.String(s3.ExpirationStatusEnabled),
+		Filter: &s3.LifecycleRuleFilter{
+			Prefix: aws.String(""),
+		},
+	}
+	if r.ExpirationDays != 0 {
+		rule.Expiration = &s3.LifecycleExpiration{
+			Days: aws.Int64(r.ExpirationDays),
+		}
+	}
+	if r.NoncurrentVersionExpirationDays != 0 {
+		rule.NoncurrentVersionExpiration = &s3.NoncurrentVersionExpiration{
+			NoncurrentDays: aws.Int64(r.NoncurrentVersionExpirationDays),
+		}
+	}
+	if r.AbortIncompleteMultipartUploadDays != 0 {
+		rule.AbortIncompleteMultipartUpload = &s3.AbortIncompleteMultipartUpload{
+			DaysAfterInitiation: aws.Int64(r.AbortIncompleteMultipartUploadDays),
+		}
+	}
+	return rule
+}
+
+// GetBucketLifecycle returns the lifecycle rules of the bucket.
+// A bucket without lifecycle configuration returns no rules and no error.
+func (s *S3Agent) GetBucketLifecycle(bucket string) ([]*s3.LifecycleRule, error) {
+	out, err := s.Client.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(bucket),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == errNoSuchLifecycleConfiguration {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return out.Rules, nil
+}
+
+// PutBucketLifecycle sets the driver managed lifecycle rule on the bucket.
+// Existing rules with a different ID are preserved, a previous driver managed rule is replaced.
+func (s *S3Agent) PutBucketLifecycle(bucket string, rules LifecycleRules) error {
+	existing, err := s.GetBucketLifecycle(bucket)
+	if err != nil {
+		return err
+	}
+
+	updated := []*s3.LifecycleRule{rules.rule()}
+	for _, r := range existing {
+		if aws.StringValue(r.ID) != DefaultLifecycleRuleID {
+			updated = append(updated, r)
+		}
+	}
+
+	_, err = s.Client.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+		Bucket: aws.String(bucket),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{
+			Rules: updated,
+		},
+	})
+	return err
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package s3client
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// lifecycleRule is the part of a lifecycle rule checked by the tests
+type lifecycleRule struct {
+	ID                       string
+	Status                   string
+	Prefix                   *string `xml:"Filter>Prefix"`
+	ExpirationDays           int64   `xml:"Expiration>Days"`
+	NoncurrentDays           int64   `xml:"NoncurrentVersionExpiration>NoncurrentDays"`
+	AbortDaysAfterInitiation int64   `xml:"AbortIncompleteMultipartUpload>DaysAfterInitiation"`
+}
+
+type lifecycleConfiguration struct {
+	XMLName xml.Name        `xml:"LifecycleConfiguration"`
+	Rules   []lifecycleRule `xml:"Rule"`
+}
+
+// lifecycleBucket serves the lifecycle configuration of a single bucket
+type lifecycleBucket struct {
+	mu       sync.Mutex
+	document []byte
+}
+
+func (b *lifecycleBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case !r.URL.Query().Has("lifecycle"):
+		w.WriteHeader(http.StatusNotImplemented)
+	case r.Method == http.MethodPut:
+		b.document, _ = io.ReadAll(r.Body)
+	case b.document == nil:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `<Error><Code>%s</Code></Error>`, errNoSuchLifecycleConfiguration)
+	default:
+		w.Write(b.document)
+	}
+}
+
+func (b *lifecycleBucket) rules(t *testing.T) []lifecycleRule {
+	t.Helper()
+	var c lifecycleConfiguration
+	if err := xml.Unmarshal(b.document, &c); err != nil {
+		t.Fatalf("invalid lifecycle configuration %s: %v", b.document, err)
+	}
+	return c.Rules
+}
+
+func TestLifecycleRulesRule(t *testing.T) {
+	rule := LifecycleRules{ExpirationDays: 30, AbortIncompleteMultipartUploadDays: 1}.rule()
+
+	if aws.StringValue(rule.ID) != DefaultLifecycleRuleID || aws.StringValue(rule.Status) != "Enabled" {
+		t.Errorf("rule() = %v, want the enabled driver rule", rule)
+	}
+	if rule.Filter == nil || rule.Filter.Prefix == nil || *rule.Filter.Prefix != "" {
+		t.Errorf("rule() filter = %v, want the whole bucket", rule.Filter)
+	}
+	if aws.Int64Value(rule.Expiration.Days) != 30 || aws.Int64Value(rule.AbortIncompleteMultipartUpload.DaysAfterInitiation) != 1 {
+		t.Errorf("rule() = %v, want expiration after 30 days and abort after 1 day", rule)
+	}
+	// a zero day count leaves its action unset
+	if rule.NoncurrentVersionExpiration != nil {
+		t.Errorf("rule() noncurrent version expiration = %v, want none", rule.NoncurrentVersionExpiration)
+	}
+}
+
+func TestPutBucketLifecycle(t *testing.T) {
+	bucket := &lifecycleBucket{}
+	server := httptest.NewServer(bucket)
+	defer server.Close()
+	agent, err := NewS3Agent("access", "secret", server.URL, "", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rules, err := agent.GetBucketLifecycle("bucket"); err != nil || rules != nil {
+		t.Fatalf("GetBucketLifecycle() = %v, %v, want no rules and no error", rules, err)
+	}
+
+	// rules set on the bucket by others
+	logs := lifecycleRule{ID: "keep-logs", Status: "Enabled", Prefix: aws.String("logs/"), ExpirationDays: 365}
+	tmp := lifecycleRule{ID: "tmp", Status: "Disabled", Prefix: aws.String("tmp/"), NoncurrentDays: 1}
+	if bucket.document, err = xml.Marshal(lifecycleConfiguration{Rules: []lifecycleRule{logs, tmp}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := agent.PutBucketLifecycle("bucket", LifecycleRules{ExpirationDays: 1, NoncurrentVersionExpirationDays: 1}); err != nil {
+		t.Fatalf("PutBucketLifecycle() error = %v", err)
+	}
+	first := lifecycleRule{ID: DefaultLifecycleRuleID, Status: "Enabled", Prefix: aws.String(""), ExpirationDays: 1, NoncurrentDays: 1}
+	if got, want := bucket.rules(t), []lifecycleRule{first, logs, tmp}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rules = %+v, want %+v", got, want)
+	}
+
+	// the driver rule of the previous call is replaced, not added
+	if err := agent.PutBucketLifecycle("bucket", LifecycleRules{ExpirationDays: 30, AbortIncompleteMultipartUploadDays: 2}); err != nil {
+		t.Fatalf("PutBucketLifecycle() error = %v", err)
+	}
+	second := lifecycleRule{ID: DefaultLifecycleRuleID, Status: "Enabled", Prefix: aws.String(""), ExpirationDays: 30, AbortDaysAfterInitiation: 2}
+	if got, want := bucket.rules(t), []lifecycleRule{second, logs, tmp}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rules = %+v, want %+v", got, want)
+	}
+}
@@ -16,67 +16,68 @@ limitations under the License.
 package s3client
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"github.com/aws/aws-sdk-go/service/s3"
-	"k8s.io/apimachinery/pkg/util/json"
 )
 
-type action string
+// Action is an S3 action that a PolicyStatement allows or denies
+type Action string
 
 const (
-	All                            action = "s3:*"
-	AbortMultipartUpload           action = "s3:AbortMultipartUpload"
-	CreateBucket                   action = "s3:CreateBucket"
-	DeleteBucketPolicy             action = "s3:DeleteBucketPolicy"
-	DeleteBucket                   action = "s3:DeleteBucket"
-	DeleteBucketWebsite            action = "s3:DeleteBucketWebsite"
-	DeleteObject                   action = "s3:DeleteObject"
-	DeleteObjectVersion            action = "s3:DeleteObjectVersion"
-	DeleteReplicationConfiguration action = "s3:DeleteReplicationConfiguration"
-	GetAccelerateConfiguration     action = "s3:GetAccelerateConfiguration"
-	GetBucketAcl                   action = "s3:GetBucketAcl"
-	GetBucketCORS                  action = "s3:GetBucketCORS"
-	GetBucketLocation              action = "s3:GetBucketLocation"
-	GetBucketLogging               action = "s3:GetBucketLogging"
-	GetBucketNotification          action = "s3:GetBucketNotification"
-	GetBucketPolicy                action = "s3:GetBucketPolicy"
-	GetBucketRequestPayment        action = "s3:GetBucketRequestPayment"
-	GetBucketTagging               action = "s3:GetBucketTagging"
-	GetBucketVersioning            action = "s3:GetBucketVersioning"
-	GetBucketWebsite               action = "s3:GetBucketWebsite"
-	GetLifecycleConfiguration      action = "s3:GetLifecycleConfiguration"
-	GetObjectAcl                   action = "s3:GetObjectAcl"
-	GetObject                      action = "s3:GetObject"
-	GetObjectTorrent               action = "s3:GetObjectTorrent"
-	GetObjectVersionAcl            action = "s3:GetObjectVersionAcl"
-	GetObjectVersion               action = "s3:GetObjectVersion"
-	GetObjectVersionTorrent        action = "s3:GetObjectVersionTorrent"
-	GetReplicationConfiguration    action = "s3:GetReplicationConfiguration"
-	ListAllMyBuckets               action = "s3:ListAllMyBuckets"
-	ListBucketMultipartUploads     action = "s3:ListBucketMultipartUploads"
-	ListBucket                     action = "s3:ListBucket"
-	ListBucketVersions             action = "s3:ListBucketVersions"
-	ListMultipartUploadParts       action = "s3:ListMultipartUploadParts"
-	PutAccelerateConfiguration     action = "s3:PutAccelerateConfiguration"
-	PutBucketAcl                   action = "s3:PutBucketAcl"
-	PutBucketCORS                  action = "s3:PutBucketCORS"
-	PutBucketLogging               action = "s3:PutBucketLogging"
-	PutBucketNotification          action = "s3:PutBucketNotification"
-	PutBucketPolicy                action = "s3:PutBucketPolicy"
-	PutBucketRequestPayment        action = "s3:PutBucketRequestPayment"
-	PutBucketTagging               action = "s3:PutBucketTagging"
-	PutBucketVersioning            action = "s3:PutBucketVersioning"
-	PutBucketWebsite               action = "s3:PutBucketWebsite"
-	PutLifecycleConfiguration      action = "s3:PutLifecycleConfiguration"
-	PutObjectAcl                   action = "s3:PutObjectAcl"
-	PutObject                      action = "s3:PutObject"
-	PutObjectVersionAcl            action = "s3:PutObjectVersionAcl"
-	PutReplicationConfiguration    action = "s3:PutReplicationConfiguration"
-	RestoreObject                  action = "s3:RestoreObject"
+	All                            Action = "s3:*"
+	AbortMultipartUpload           Action = "s3:AbortMultipartUpload"
+	CreateBucket                   Action = "s3:CreateBucket"
+	DeleteBucketPolicy             Action = "s3:DeleteBucketPolicy"
+	DeleteBucket                   Action = "s3:DeleteBucket"
+	DeleteBucketWebsite            Action = "s3:DeleteBucketWebsite"
+	DeleteObject                   Action = "s3:DeleteObject"
+	DeleteObjectVersion            Action = "s3:DeleteObjectVersion"
+	DeleteReplicationConfiguration Action = "s3:DeleteReplicationConfiguration"
+	GetAccelerateConfiguration     Action = "s3:GetAccelerateConfiguration"
+	GetBucketAcl                   Action = "s3:GetBucketAcl"
+	GetBucketCORS                  Action = "s3:GetBucketCORS"
+	GetBucketLocation              Action = "s3:GetBucketLocation"
+	GetBucketLogging               Action = "s3:GetBucketLogging"
+	GetBucketNotification          Action = "s3:GetBucketNotification"
+	GetBucketPolicy                Action = "s3:GetBucketPolicy"
+	GetBucketRequestPayment        Action = "s3:GetBucketRequestPayment"
+	GetBucketTagging               Action = "s3:GetBucketTagging"
+	GetBucketVersioning            Action = "s3:GetBucketVersioning"
+	GetBucketWebsite               Action = "s3:GetBucketWebsite"
+	GetLifecycleConfiguration      Action = "s3:GetLifecycleConfiguration"
+	GetObjectAcl                   Action = "s3:GetObjectAcl"
+	GetObject                      Action = "s3:GetObject"
+	GetObjectTorrent               Action = "s3:GetObjectTorrent"
+	GetObjectVersionAcl            Action = "s3:GetObjectVersionAcl"
+	GetObjectVersion               Action = "s3:GetObjectVersion"
+	GetObjectVersionTorrent        Action = "s3:GetObjectVersionTorrent"
+	GetReplicationConfiguration    Action = "s3:GetReplicationConfiguration"
+	ListAllMyBuckets               Action = "s3:ListAllMyBuckets"
+	ListBucketMultipartUploads     Action = "s3:ListBucketMultipartUploads"
+	ListBucket                     Action = "s3:ListBucket"
+	ListBucketVersions             Action = "s3:ListBucketVersions"
+	ListMultipartUploadParts       Action = "s3:ListMultipartUploadParts"
+	PutAccelerateConfiguration     Action = "s3:PutAccelerateConfiguration"
+	PutBucketAcl                   Action = "s3:PutBucketAcl"
+	PutBucketCORS                  Action = "s3:PutBucketCORS"
+	PutBucketLogging               Action = "s3:PutBucketLogging"
+	PutBucketNotification          Action = "s3:PutBucketNotification"
+	PutBucketPolicy                Action = "s3:PutBucketPolicy"
+	PutBucketRequestPayment        Action = "s3:PutBucketRequestPayment"
+	PutBucketTagging               Action = "s3:PutBucketTagging"
+	PutBucketVersioning            Action = "s3:PutBucketVersioning"
+	PutBucketWebsite               Action = "s3:PutBucketWebsite"
+	PutLifecycleConfiguration      Action = "s3:PutLifecycleConfiguration"
+	PutObjectAcl                   Action = "s3:PutObjectAcl"
+	PutObject                      Action = "s3:PutObject"
+	PutObjectVersionAcl            Action = "s3:PutObjectVersionAcl"
+	PutReplicationConfiguration    Action = "s3:PutReplicationConfiguration"
+	RestoreObject                  Action = "s3:RestoreObject"
 )
 
-var AllowedActions = []action{
+var AllowedActions = []Action{
 	AbortMultipartUpload,
 	DeleteObject,
 	GetBucketLocation,
@@ -88,38 +89,137 @@ var AllowedActions = []action{
 	PutLifecycleConfiguration,
 }
 
+// Named sets of actions that can be granted on a bucket
+var (
+	ReadOnlyActions = []Action{
+		GetBucketLocation,
+		GetObject,
+		ListBucket,
+	}
+	WriteOnlyActions = []Action{
+		AbortMultipartUpload,
+		GetBucketLocation,
+		ListBucketMultipartUploads,
+		ListMultipartUploadParts,
+		PutObject,
+	}
+	ReadWriteActions = []Action{
+		AbortMultipartUpload,
+		DeleteObject,
+		GetBucketLocation,
+		GetObject,
+		ListBucket,
+		ListBucketMultipartUploads,
+		ListMultipartUploadParts,
+		PutObject,
+	}
+	AdminActions = []Action{
+		All,
+	}
+)
+
+// objectActions are the actions that apply to the objects of a bucket
+// rather than to the bucket itself
+var objectActions = map[Action]bool{
+	AbortMultipartUpload:     true,
+	DeleteObject:             true,
+	DeleteObjectVersion:      true,
+	GetObjectAcl:             true,
+	GetObject:                true,
+	GetObjectTorrent:         true,
+	GetObjectVersionAcl:      true,
+	GetObjectVersion:         true,
+	GetObjectVersionTorrent:  true,
+	ListMultipartUploadParts: true,
+	PutObjectAcl:             true,
+	PutObject:                true,
+	PutObjectVersionAcl:      true,
+	RestoreObject:            true,
+}
+
+// IsObjectAction reports whether the action applies to objects, s3:* applies to both objects and buckets
+func IsObjectAction(a Action) bool {
+	return a == All || objectActions[a]
+}
+
+// knownActions holds every Action constant
+var knownActions = map[Action]bool{}
+
+func init() {
+	for _, a := range []Action{
+		All, AbortMultipartUpload, CreateBucket, DeleteBucketPolicy, DeleteBucket, DeleteBucketWebsite,
+		DeleteObject, DeleteObjectVersion, DeleteReplicationConfiguration, GetAccelerateConfiguration,
+		GetBucketAcl, GetBucketCORS, GetBucketLocation, GetBucketLogging, GetBucketNotification,
+		GetBucketPolicy, GetBucketRequestPayment, GetBucketTagging, GetBucketVersioning, GetBucketWebsite,
+		GetLifecycleConfiguration, GetObjectAcl, GetObject, GetObjectTorrent, GetObjectVersionAcl,
+		GetObjectVersion, GetObjectVersionTorrent, GetReplicationConfiguration, ListAllMyBuckets,
+		ListBucketMultipartUploads, ListBucket, ListBucketVersions, ListMultipartUploadParts,
+		PutAccelerateConfiguration, PutBucketAcl, PutBucketCORS, PutBucketLogging, PutBucketNotification,
+		PutBucketPolicy, PutBucketRequestPayment, PutBucketTagging, PutBucketVersioning, PutBucketWebsite,
+		PutLifecycleConfiguration, PutObjectAcl, PutObject, PutObjectVersionAcl, PutReplicationConfiguration,
+		RestoreObject,
+	} {
+		knownActions[a] = true
+	}
+}
+
+// ParseAction returns the Action constant named by s, such as "s3:GetObject"
+func ParseAction(s string) (Action, error) {
+	a := Action(s)
+	if !knownActions[a] {
+		return "", fmt.Errorf("unknown action %q", s)
+	}
+	return a, nil
+}
+
 type effect string
 
-// effectAllow values are expected by the S3 API to be 'Allow' explicitly
+// effectAllow and effectDeny values are expected by the S3 API to be 'Allow' and 'Deny' explicitly
 const (
 	effectAllow effect = "Allow"
+	effectDeny  effect = "Deny"
 )
 
 // PolicyStatment is the Go representation of a PolicyStatement json struct
 // it defines what Actions that a Principle can or cannot perform on a Resource
 type PolicyStatement struct {
 	// Sid (optional) is the PolicyStatement's unique identifier
-	Sid string `json:"Sid"`
-	// Effect determines whether the Action(s) are 'Allow'ed
+	Sid string `json:"Sid,omitempty"`
+	// Effect determines whether the Action(s) are 'Allow'ed or 'Deny'ed
 	Effect effect `json:"Effect"`
 	// Principle is/are the nutanix user names affected by this PolicyStatement
 	// Must be in the format of '<username>'
-	Principal map[string][]string `json:"Principal"`
+	Principal PrincipalMap `json:"Principal,omitempty"`
+	// NotPrincipal is/are the nutanix user names excluded from this PolicyStatement,
+	// used instead of Principal
+	NotPrincipal PrincipalMap `json:"NotPrincipal,omitempty"`
 	// Action is a list of s3:* actions
-	Action []action `json:"Action"`
+	Action ActionList `json:"Action,omitempty"`
+	// NotAction is a list of s3:* actions excluded from this PolicyStatement, used instead of Action
+	NotAction ActionList `json:"NotAction,omitempty"`
 	// Resource is the ARN identifier for the S3 resource (bucket)
 	// Must be in the format of 'arn:aws:s3:::<bucket>'
-	Resource []string `json:"Resource"`
+	Resource StringList `json:"Resource,omitempty"`
+	// NotResource is the ARN identifier of the S3 resources excluded from this PolicyStatement,
+	// used instead of Resource
+	NotResource StringList `json:"NotResource,omitempty"`
+	// Condition (optional) restricts when the PolicyStatement applies.
+	// It maps a condition operator to the condition keys and their values
+	Condition ConditionMap `json:"Condition,omitempty"`
+	// Extra holds the statement elements not modelled above, they are written back unchanged
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 // BucketPolicy represents set of policy statements for a single bucket.
 type BucketPolicy struct {
 	// Id (optional) identifies the bucket policy
-	Id string `json:"Id"`
+	Id string `json:"Id,omitempty"`
 	// Version is the version of the BucketPolicy data structure
 	// should always be '2012-10-17'
-	Version   string            `json:"Version"`
-	Statement []PolicyStatement `json:"Statement"`
+	Version   string        `json:"Version"`
+	Statement StatementList `json:"Statement"`
+	// Extra holds the policy elements not modelled above, they are written back unchanged
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 // the version of the BucketPolicy json structure
@@ -139,7 +239,10 @@ func NewBucketPolicy(ps ...PolicyStatement) *BucketPolicy {
 func (s *S3Agent) PutBucketPolicy(bucket string, policy BucketPolicy) (*s3.PutBucketPolicyOutput, error) {
 
 	confirmRemoveSelfBucketAccess := false
-	serializedPolicy, _ := json.Marshal(policy)
+	serializedPolicy, err := json.Marshal(policy)
+	if err != nil {
+		return nil, err
+	}
 	consumablePolicy := string(serializedPolicy)
 
 	p := &s3.PutBucketPolicyInput{
@@ -170,6 +273,14 @@ func (s *S3Agent) GetBucketPolicy(bucket string) (*BucketPolicy, error) {
 	return policy, nil
 }
 
+// DeleteBucketPolicy removes the policy of the bucket
+func (s *S3Agent) DeleteBucketPolicy(bucket string) error {
+	_, err := s.Client.DeleteBucketPolicy(&s3.DeleteBucketPolicyInput{
+		Bucket: &bucket,
+	})
+	return err
+}
+
 // ModifyBucketPolicy new and old statement SIDs and overwrites on a match.
 // This allows users to Get, modify, and Replace existing statements as well as
 // add new ones.
@@ -179,6 +290,8 @@ func (bp *BucketPolicy) ModifyBucketPolicy(ps ...PolicyStatement) *BucketPolicy
 		for j, oldP := range bp.Statement {
 			if newP.Sid == oldP.Sid {
 				bp.Statement[j] = newP
+				match = true
+				break
 			}
 		}
 		if !match {
@@ -188,22 +301,46 @@ func (bp *BucketPolicy) ModifyBucketPolicy(ps ...PolicyStatement) *BucketPolicy
 	return bp
 }
 
+// DropPolicyStatements removes the statements with the given SIDs
 func (bp *BucketPolicy) DropPolicyStatements(sid ...string) *BucketPolicy {
+	drop := map[string]bool{}
 	for _, s := range sid {
-		for i, stmt := range bp.Statement {
-			if stmt.Sid == s {
-				bp.Statement = append(bp.Statement[:i], bp.Statement[i+1:]...)
-				break
-			}
+		drop[s] = true
+	}
+	statements := []PolicyStatement{}
+	for _, stmt := range bp.Statement {
+		if !drop[stmt.Sid] {
+			statements = append(statements, stmt)
 		}
 	}
+	bp.Statement = statements
 	return bp
 }
 
+// ExtractStatements removes the statements for which match returns true and returns them
+func (bp *BucketPolicy) ExtractStatements(match func(PolicyStatement) bool) []PolicyStatement {
+	statements := []PolicyStatement{}
+	extracted := []PolicyStatement{}
+	for _, stmt := range bp.Statement {
+		if match(stmt) {
+			extracted = append(extracted, stmt)
+		} else {
+			statements = append(statements, stmt)
+		}
+	}
+	bp.Statement = statements
+	return extracted
+}
+
+// EjectPrincipals removes the users from the principals of every statement.
+// A statement left without any principal is removed, as it would no longer be a valid statement.
 func (bp *BucketPolicy) EjectPrincipals(users ...string) *BucketPolicy {
-	statements := bp.Statement
-	for _, s := range statements {
-		s.EjectPrincipals(users...)
+	statements := []PolicyStatement{}
+	for _, stmt := range bp.Statement {
+		if stmt.EjectPrincipals(users...) && len(stmt.Principal) == 0 {
+			continue
+		}
+		statements = append(statements, stmt)
 	}
 	bp.Statement = statements
 	return bp
@@ -216,9 +353,9 @@ func NewPolicyStatement() *PolicyStatement {
 	return &PolicyStatement{
 		Sid:       "",
 		Effect:    "",
-		Principal: map[string][]string{},
-		Action:    []action{},
-		Resource:  []string{},
+		Principal: PrincipalMap{},
+		Action:    ActionList{},
+		Resource:  StringList{},
 	}
 }
 
@@ -258,6 +395,16 @@ func (ps *PolicyStatement) ForSubResources(resources ...string) *PolicyStatement
 	return ps
 }
 
+// Principals returns the users the PolicyStatement applies to
+func (ps *PolicyStatement) Principals() []string {
+	return ps.Principal[awsPrinciple]
+}
+
+// IsAllow reports whether the PolicyStatement allows its Actions
+func (ps *PolicyStatement) IsAllow() bool {
+	return ps.Effect == effectAllow
+}
+
 // Allows sets the effect of the PolicyStatement to allow PolicyStatement's Actions
 func (ps *PolicyStatement) Allows() *PolicyStatement {
 	if ps.Effect != "" {
@@ -267,20 +414,69 @@ func (ps *PolicyStatement) Allows() *PolicyStatement {
 	return ps
 }
 
+// Denies sets the effect of the PolicyStatement to deny PolicyStatement's Actions
+func (ps *PolicyStatement) Denies() *PolicyStatement {
+	if ps.Effect != "" {
+		return ps
+	}
+	ps.Effect = effectDeny
+	return ps
+}
+
 // Actions is the set of "s3:*" actions for the PolicyStatement is concerned
-func (ps *PolicyStatement) Actions(actions ...action) *PolicyStatement {
+func (ps *PolicyStatement) Actions(actions ...Action) *PolicyStatement {
 	ps.Action = actions
 	return ps
 }
 
-func (ps *PolicyStatement) EjectPrincipals(users ...string) {
-	principals := ps.Principal[awsPrinciple]
+// NotActions is the set of "s3:*" actions the PolicyStatement is not concerned with,
+// the statement applies to every other action
+func (ps *PolicyStatement) NotActions(actions ...Action) *PolicyStatement {
+	ps.NotAction = actions
+	return ps
+}
+
+// NotPrincipals adds users excluded from the PolicyStatement,
+// the statement applies to everyone else
+func (ps *PolicyStatement) NotPrincipals(users ...string) *PolicyStatement {
+	if ps.NotPrincipal == nil {
+		ps.NotPrincipal = PrincipalMap{}
+	}
+	ps.NotPrincipal[awsPrinciple] = append(ps.NotPrincipal[awsPrinciple], users...)
+	return ps
+}
+
+// NotResources adds resources (buckets) excluded from the PolicyStatement with the appropriate ARN prefix,
+// the statement applies to every other resource
+func (ps *PolicyStatement) NotResources(resources ...string) *PolicyStatement {
+	for _, v := range resources {
+		ps.NotResource = append(ps.NotResource, fmt.Sprintf(arnPrefixResource, v))
+	}
+	return ps
+}
+
+// EjectPrincipals removes users from the PolicyStatement and reports whether any of them was a principal.
+// The AWS principal type is dropped once it has no user left.
+func (ps *PolicyStatement) EjectPrincipals(users ...string) bool {
+	eject := map[string]bool{}
 	for _, u := range users {
-		for j, v := range principals {
-			if u == v {
-				principals = append(principals[:j], principals[:j+1]...)
-			}
+		eject[u] = true
+	}
+
+	principals := StringList{}
+	for _, v := range ps.Principal[awsPrinciple] {
+		if !eject[v] {
+			principals = append(principals, v)
 		}
 	}
-	ps.Principal[awsPrinciple] = principals
+	ejected := len(principals) != len(ps.Principal[awsPrinciple])
+	if !ejected {
+		return false
+	}
+	if len(principals) == 0 {
+		delete(ps.Principal, awsPrinciple)
+	} else {
+		ps.Principal[awsPrinciple] = principals
+	}
+	return true
 }
@@ -0,0 +1,219 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package s3client
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// The S3 policy grammar allows most elements to be either a single value or a list of values,
+// and Principal to be the wildcard "*". The types below accept every such shape, and keep
+// elements they do not model, so that a policy written by an admin survives a Get/Put round trip.
+
+// StringList is a policy element holding either a single string or a list of strings.
+// It is always serialized as a list.
+type StringList []string
+
+func (l *StringList) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*l = StringList{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*l = many
+	return nil
+}
+
+// ActionList is the Action or NotAction element of a statement, a single action or a list of actions.
+// It is always serialized as a list.
+type ActionList []Action
+
+func (l *ActionList) UnmarshalJSON(data []byte) error {
+	var names StringList
+	if err := json.Unmarshal(data, &names); err != nil {
+		return err
+	}
+	actions := make(ActionList, 0, len(names))
+	for _, n := range names {
+		actions = append(actions, Action(n))
+	}
+	*l = actions
+	return nil
+}
+
+// principalWildcard is the Principal matching everyone
+const principalWildcard = "*"
+
+// PrincipalMap is the Principal or NotPrincipal element of a statement.
+// It maps a principal type such as "AWS" to the principal IDs.
+// The wildcard principal "*" is kept as the single key "*" and serialized back as "*".
+type PrincipalMap map[string]StringList
+
+func (m *PrincipalMap) UnmarshalJSON(data []byte) error {
+	var wildcard string
+	if err := json.Unmarshal(data, &wildcard); err == nil {
+		*m = PrincipalMap{wildcard: nil}
+		return nil
+	}
+	var principals map[string]StringList
+	if err := json.Unmarshal(data, &principals); err != nil {
+		return err
+	}
+	*m = principals
+	return nil
+}
+
+func (m PrincipalMap) MarshalJSON() ([]byte, error) {
+	if _, ok := m[principalWildcard]; ok && len(m) == 1 {
+		return json.Marshal(principalWildcard)
+	}
+	return json.Marshal(map[string]StringList(m))
+}
+
+// ConditionValues holds the values of a condition key, a single value or a list of values.
+// Values are kept with their json type (string, bool or number) and serialized as a list.
+type ConditionValues []interface{}
+
+func (v *ConditionValues) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return err
+	}
+	if values, ok := value.([]interface{}); ok {
+		*v = values
+	} else {
+		*v = ConditionValues{value}
+	}
+	return nil
+}
+
+// ConditionMap is the Condition element of a statement, it maps condition operators to condition keys and their values
+type ConditionMap map[string]map[string]ConditionValues
+
+// StatementList is the Statement element of a policy, a single statement or a list of statements.
+// It is always serialized as a list.
+type StatementList []PolicyStatement
+
+func (l *StatementList) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var one PolicyStatement
+		if err := json.Unmarshal(data, &one); err != nil {
+			return err
+		}
+		*l = StatementList{one}
+		return nil
+	}
+	var many []PolicyStatement
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*l = many
+	return nil
+}
+
+// policyStatement and bucketPolicy have the fields of PolicyStatement and BucketPolicy but not their
+// json methods, they are used to encode the modelled elements
+type policyStatement PolicyStatement
+type bucketPolicy BucketPolicy
+
+var (
+	statementElements = []string{"Sid", "Effect", "Principal", "NotPrincipal", "Action", "NotAction", "Resource", "NotResource", "Condition"}
+	policyElements    = []string{"Id", "Version", "Statement"}
+)
+
+func (ps *PolicyStatement) UnmarshalJSON(data []byte) error {
+	var statement policyStatement
+	if err := json.Unmarshal(data, &statement); err != nil {
+		return err
+	}
+	extra, err := unmodelledElements(data, statementElements)
+	if err != nil {
+		return err
+	}
+	statement.Extra = extra
+	*ps = PolicyStatement(statement)
+	return nil
+}
+
+func (ps PolicyStatement) MarshalJSON() ([]byte, error) {
+	return marshalWithElements(policyStatement(ps), ps.Extra)
+}
+
+func (bp *BucketPolicy) UnmarshalJSON(data []byte) error {
+	var policy bucketPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return err
+	}
+	extra, err := unmodelledElements(data, policyElements)
+	if err != nil {
+		return err
+	}
+	policy.Extra = extra
+	*bp = BucketPolicy(policy)
+	return nil
+}
+
+func (bp BucketPolicy) MarshalJSON() ([]byte, error) {
+	return marshalWithElements(bucketPolicy(bp), bp.Extra)
+}
+
+// unmodelledElements returns the elements of the json object data that are not listed in known.
+// Element names are matched case-insensitively, like encoding/json matches struct fields.
+func unmodelledElements(data []byte, known []string) (map[string]json.RawMessage, error) {
+	var elements map[string]json.RawMessage
+	if err := json.Unmarshal(data, &elements); err != nil {
+		return nil, err
+	}
+	for name := range elements {
+		for _, k := range known {
+			if strings.EqualFold(name, k) {
+				delete(elements, name)
+				break
+			}
+		}
+	}
+	if len(elements) == 0 {
+		return nil, nil
+	}
+	return elements, nil
+}
+
+// marshalWithElements serializes v and adds the extra elements to the resulting json object
+func marshalWithElements(v interface{}, extra map[string]json.RawMessage) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return data, err
+	}
+
+	var elements map[string]json.RawMessage
+	if err := json.Unmarshal(data, &elements); err != nil {
+		return nil, err
+	}
+	for name, value := range extra {
+		if _, ok := elements[name]; !ok {
+			elements[name] = value
+		}
+	}
+	return json.Marshal(elements)
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package s3client
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// rewrite reads a policy document and writes it back
+func rewrite(t *testing.T, document string) (*BucketPolicy, string) {
+	t.Helper()
+	policy := &BucketPolicy{}
+	if err := json.Unmarshal([]byte(document), policy); err != nil {
+		t.Fatalf("Unmarshal(%s) error = %v", document, err)
+	}
+	data, err := json.Marshal(policy)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	return policy, string(data)
+}
+
+// sameJSON reports whether a and b hold the same json document, regardless of key order and spacing
+func sameJSON(t *testing.T, a, b string) bool {
+	t.Helper()
+	var va, vb interface{}
+	if err := json.Unmarshal([]byte(a), &va); err != nil {
+		t.Fatalf("invalid json %s: %v", a, err)
+	}
+	if err := json.Unmarshal([]byte(b), &vb); err != nil {
+		t.Fatalf("invalid json %s: %v", b, err)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+func TestBucketPolicyWrittenBackWithoutLoss(t *testing.T) {
+	documents := []string{
+		// lists
+		`{"Version":"2012-10-17","Statement":[{"Sid":"a","Effect":"Allow","Principal":{"AWS":["u1","u2"]},"Action":["s3:GetObject","s3:ListBucket"],"Resource":["arn:aws:s3:::b","arn:aws:s3:::b/*"]}]}`,
+		// wildcard principal
+		`{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":"*","Action":["s3:GetObject"],"Resource":["arn:aws:s3:::b/*"]}]}`,
+		// negated elements
+		`{"Version":"2012-10-17","Statement":[{"Effect":"Deny","NotPrincipal":{"AWS":["admin"]},"NotAction":["s3:GetObject"],"NotResource":["arn:aws:s3:::b/public/*"]}]}`,
+		// condition values keep their json type
+		`{"Version":"2012-10-17","Statement":[{"Effect":"Deny","Principal":"*","Action":["s3:*"],"Resource":["arn:aws:s3:::b"],"Condition":{"Bool":{"aws:SecureTransport":[false]},"NumericGreaterThan":{"s3:max-keys":[10]}}}]}`,
+		// elements the driver does not model
+		`{"Version":"2012-10-17","Id":"p","Comment":{"by":"admin"},"Statement":[{"Effect":"Allow","Principal":{"AWS":["u1"]},"Action":["s3:GetObject"],"Resource":["arn:aws:s3:::b/*"],"Custom":[1,2]}]}`,
+	}
+	for _, document := range documents {
+		policy, got := rewrite(t, document)
+		if !sameJSON(t, got, document) {
+			t.Errorf("policy %s\nwritten back as %s", document, got)
+		}
+		if again, _ := rewrite(t, got); !reflect.DeepEqual(again, policy) {
+			t.Errorf("policy read back = %+v, want %+v", again, policy)
+		}
+	}
+}
+
+func TestBucketPolicyNormalized(t *testing.T) {
+	// single values are written as lists and modelled elements are matched in any case
+	_, got := rewrite(t, `{"version":"2012-10-17","statement":{"effect":"Allow","principal":{"AWS":"u1"},"action":"s3:GetObject","resource":"arn:aws:s3:::b/*","condition":{"IpAddress":{"aws:SourceIp":"10.0.0.0/8"}}}}`)
+	want := `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":{"AWS":["u1"]},"Action":["s3:GetObject"],"Resource":["arn:aws:s3:::b/*"],"Condition":{"IpAddress":{"aws:SourceIp":["10.0.0.0/8"]}}}]}`
+	if !sameJSON(t, got, want) {
+		t.Errorf("Marshal() = %s, want %s", got, want)
+	}
+}
+
+func TestBucketPolicyUnmarshalErrors(t *testing.T) {
+	for _, document := range []string{
+		`[]`,
+		`{"Version":"2012-10-17","Statement":"s"}`,
+		`{"Version":"2012-10-17","Statement":[{"Action":1}]}`,
+		`{"Version":"2012-10-17","Statement":[{"Principal":["u1"]}]}`,
+		`{"Version":"2012-10-17","Statement":[{"Resource":{"a":"b"}}]}`,
+		`{"Version":"2012-10-17","Statement":[{"Condition":{"Bool":["x"]}}]}`,
+	} {
+		if err := json.Unmarshal([]byte(document), &BucketPolicy{}); err == nil {
+			t.Errorf("Unmarshal(%s) succeeded", document)
+		}
+	}
+}
+
+func TestPrincipalMapMarshal(t *testing.T) {
+	if got, _ := json.Marshal(PrincipalMap{"*": nil}); string(got) != `"*"` {
+		t.Errorf("wildcard principal = %s, want \"*\"", got)
+	}
+	// the wildcard is only written as a string when it is the sole principal
+	if got, _ := json.Marshal(PrincipalMap{"*": nil, "AWS": {"u1"}}); string(got) != `{"*":null,"AWS":["u1"]}` {
+		t.Errorf("principal = %s, want the map", got)
+	}
+}
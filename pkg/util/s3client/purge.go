@@ -0,0 +1,167 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package s3client
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ErrBucketNotEmpty is returned by DeleteBucket when the bucket still holds objects
+	ErrBucketNotEmpty = "BucketNotEmpty"
+
+	// purgeBatchSize is the maximum number of keys accepted by a single DeleteObjects call
+	purgeBatchSize = 1000
+	// purgeWorkers is the number of DeleteObjects calls issued concurrently
+	purgeWorkers = 8
+)
+
+// PurgeBucket removes every object version, delete marker and in-progress multipart upload from the bucket,
+// leaving it empty so that it can be deleted.
+func (s *S3Agent) PurgeBucket(name string) error {
+	klog.InfoS("Purging bucket", "name", name)
+
+	if err := s.abortMultipartUploads(name); err != nil {
+		return fmt.Errorf("failed to abort multipart uploads of bucket %q: %w", name, err)
+	}
+	if err := s.deleteObjectVersions(name); err != nil {
+		return fmt.Errorf("failed to delete objects of bucket %q: %w", name, err)
+	}
+
+	klog.InfoS("Successfully purged bucket", "name", name)
+	return nil
+}
+
+func (s *S3Agent) abortMultipartUploads(name string) error {
+	var abortErr error
+	err := s.Client.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+		Bucket: aws.String(name),
+	}, func(page *s3.ListMultipartUploadsOutput, _ bool) bool {
+		for _, upload := range page.Uploads {
+			_, abortErr = s.Client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(name),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if abortErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return abortErr
+}
+
+// deleteObjectVersions lists all object versions and delete markers of the bucket
+// and hands them in batches to a pool of DeleteObjects workers.
+func (s *S3Agent) deleteObjectVersions(name string) error {
+	batches := make(chan []*s3.ObjectIdentifier)
+	errs := make(chan error, purgeWorkers)
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < purgeWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				if err := s.deleteObjects(name, batch); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var batch []*s3.ObjectIdentifier
+	var workerErr error
+	// send hands a batch to the workers and reports false once a worker has failed
+	send := func(b []*s3.ObjectIdentifier) bool {
+		select {
+		case batches <- b:
+			return true
+		case workerErr = <-errs:
+			return false
+		}
+	}
+
+	listErr := s.Client.ListObjectVersionsPages(&s3.ListObjectVersionsInput{
+		Bucket: aws.String(name),
+	}, func(page *s3.ListObjectVersionsOutput, _ bool) bool {
+		for _, v := range page.Versions {
+			batch = append(batch, &s3.ObjectIdentifier{Key: v.Key, VersionId: v.VersionId})
+		}
+		for _, m := range page.DeleteMarkers {
+			batch = append(batch, &s3.ObjectIdentifier{Key: m.Key, VersionId: m.VersionId})
+		}
+		for len(batch) >= purgeBatchSize {
+			if !send(batch[:purgeBatchSize]) {
+				return false
+			}
+			batch = batch[purgeBatchSize:]
+		}
+		return true
+	})
+	if listErr == nil && workerErr == nil && len(batch) > 0 {
+		send(batch)
+	}
+	close(batches)
+	<-done
+
+	if listErr != nil {
+		return listErr
+	}
+	if workerErr != nil {
+		return workerErr
+	}
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+func (s *S3Agent) deleteObjects(name string, objects []*s3.ObjectIdentifier) error {
+	out, err := s.Client.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String(name),
+		Delete: &s3.Delete{
+			Objects: objects,
+			Quiet:   aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if len(out.Errors) > 0 {
+		e := out.Errors[0]
+		return fmt.Errorf("failed to delete %d objects, first failure on %q: %s %s",
+			len(out.Errors), aws.StringValue(e.Key), aws.StringValue(e.Code), aws.StringValue(e.Message))
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package s3client
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// versionedBucket serves the listing and delete calls of PurgeBucket for a single bucket
+type versionedBucket struct {
+	mu sync.Mutex
+	// entries are the object versions and delete markers, by "<key>@<versionId>", true for delete markers
+	entries map[string]bool
+	// uploads are the keys of the in-progress multipart uploads, by upload ID
+	uploads map[string]string
+	// pageSize is the number of entries per listing page
+	pageSize int
+	// failKey makes DeleteObjects report a failure for the object with this key
+	failKey string
+	// batches are the number of objects of each DeleteObjects call
+	batches []int
+}
+
+func newVersionedBucket(versions, markers, uploads, pageSize int) *versionedBucket {
+	b := &versionedBucket{entries: map[string]bool{}, uploads: map[string]string{}, pageSize: pageSize}
+	for i := 0; i < versions+markers; i++ {
+		b.entries[fmt.Sprintf("obj-%05d@v%d", i, i)] = i >= versions
+	}
+	for i := 0; i < uploads; i++ {
+		b.uploads[fmt.Sprintf("mpu-%d", i)] = fmt.Sprintf("upload-%d", i)
+	}
+	return b
+}
+
+func (b *versionedBucket) purge(t *testing.T) error {
+	t.Helper()
+	server := httptest.NewServer(b)
+	defer server.Close()
+	agent, err := NewS3Agent("access", "secret", server.URL, "", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return agent.PurgeBucket("bucket")
+}
+
+func (b *versionedBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	query := r.URL.Query()
+	switch {
+	case query.Has("versions"):
+		b.listVersions(w, query.Get("key-marker"))
+	case query.Has("delete"):
+		b.deleteObjects(w, r)
+	case query.Has("uploads"):
+		fmt.Fprint(w, `<ListMultipartUploadsResult><IsTruncated>false</IsTruncated>`)
+		for id, key := range b.uploads {
+			fmt.Fprintf(w, `<Upload><Key>%s</Key><UploadId>%s</UploadId></Upload>`, key, id)
+		}
+		fmt.Fprint(w, `</ListMultipartUploadsResult>`)
+	case query.Has("uploadId") && r.Method == http.MethodDelete:
+		delete(b.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// listVersions lists a page of the entries after marker in key order, the last entry of a
+// truncated page is handed back as the next key marker
+func (b *versionedBucket) listVersions(w http.ResponseWriter, marker string) {
+	var entries []string
+	for e := range b.entries {
+		if e > marker {
+			entries = append(entries, e)
+		}
+	}
+	sort.Strings(entries)
+	truncated := len(entries) > b.pageSize
+	if truncated {
+		entries = entries[:b.pageSize]
+	}
+
+	fmt.Fprintf(w, `<ListVersionsResult><IsTruncated>%t</IsTruncated>`, truncated)
+	if truncated {
+		fmt.Fprintf(w, `<NextKeyMarker>%s</NextKeyMarker><NextVersionIdMarker>v</NextVersionIdMarker>`, entries[len(entries)-1])
+	}
+	for _, e := range entries {
+		key, version, _ := strings.Cut(e, "@")
+		element := "Version"
+		if b.entries[e] {
+			element = "DeleteMarker"
+		}
+		fmt.Fprintf(w, `<%s><Key>%s</Key><VersionId>%s</VersionId></%s>`, element, key, version, element)
+	}
+	fmt.Fprint(w, `</ListVersionsResult>`)
+}
+
+func (b *versionedBucket) deleteObjects(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Objects []struct {
+			Key       string
+			VersionId string
+		} `xml:"Object"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	b.batches = append(b.batches, len(req.Objects))
+
+	fmt.Fprint(w, `<DeleteResult>`)
+	for _, o := range req.Objects {
+		if o.Key == b.failKey {
+			fmt.Fprintf(w, `<Error><Key>%s</Key><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`, o.Key)
+			continue
+		}
+		delete(b.entries, o.Key+"@"+o.VersionId)
+	}
+	fmt.Fprint(w, `</DeleteResult>`)
+}
+
+func TestPurgeBucket(t *testing.T) {
+	// listing pages smaller than, equal to and larger than a DeleteObjects batch
+	for _, pageSize := range []int{700, purgeBatchSize, 2100} {
+		t.Run(fmt.Sprintf("pages of %d", pageSize), func(t *testing.T) {
+			b := newVersionedBucket(2500, 300, 2, pageSize)
+			if err := b.purge(t); err != nil {
+				t.Fatalf("PurgeBucket() error = %v", err)
+			}
+			if len(b.entries) != 0 || len(b.uploads) != 0 {
+				t.Errorf("%d object versions and %d multipart uploads left", len(b.entries), len(b.uploads))
+			}
+
+			// every batch but the remainder is full, whatever the page size
+			deleted, partial := 0, 0
+			for _, n := range b.batches {
+				deleted += n
+				if n != purgeBatchSize {
+					partial++
+				}
+			}
+			if deleted != 2800 || partial > 1 {
+				t.Errorf("batches = %v, want 2800 objects in full batches of %d and one remainder", b.batches, purgeBatchSize)
+			}
+		})
+	}
+}
+
+func TestPurgeEmptyBucket(t *testing.T) {
+	b := newVersionedBucket(0, 0, 3, purgeBatchSize)
+	if err := b.purge(t); err != nil {
+		t.Fatalf("PurgeBucket() error = %v", err)
+	}
+	if len(b.uploads) != 0 {
+		t.Errorf("%d multipart uploads left", len(b.uploads))
+	}
+	if len(b.batches) != 0 {
+		t.Errorf("batches = %v, want no DeleteObjects call", b.batches)
+	}
+}
+
+func TestPurgeBucketFailure(t *testing.T) {
+	b := newVersionedBucket(5000, 0, 0, purgeBatchSize)
+	b.failKey = "obj-00042"
+
+	err := b.purge(t)
+	if err == nil {
+		t.Fatal("PurgeBucket() succeeded while an object could not be deleted")
+	}
+	if !strings.Contains(err.Error(), b.failKey) || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("PurgeBucket() error = %v, want the failed key and its code", err)
+	}
+}
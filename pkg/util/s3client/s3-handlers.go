@@ -18,9 +18,13 @@ package s3client
 
 import (
 	"bytes"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/nutanix-core/k8s-ntnx-object-cosi/pkg/util/transport"
@@ -28,18 +32,61 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"k8s.io/klog/v2"
 )
 
 const (
-	ErrNoSuchBucket = "NoSuchBucket"
+	ErrNoSuchBucket       = "NoSuchBucket"
+	ErrNoSuchTagSet       = "NoSuchTagSet"
+	ErrNoSuchBucketPolicy = "NoSuchBucketPolicy"
+)
+
+var (
+	// ErrBucketAlreadyExists is returned by CreateBucket when the bucket name is taken by another account
+	ErrBucketAlreadyExists = errors.New("bucket already exists")
+	// ErrBucketAlreadyOwnedByYou is returned by CreateBucket when the bucket already exists in the admin account
+	ErrBucketAlreadyOwnedByYou = errors.New("bucket already owned by you")
 )
 
 // S3Agent wraps the s3.S3 structure to allow for wrapper methods
 type S3Agent struct {
 	Client *s3.S3
+	// endpoint replaces the endpoint the agent was created with once set by SetEndpoint
+	endpoint atomic.Pointer[url.URL]
+	// keys are the access keys signing the requests, replaced by SetCredentials
+	keys *swappableProvider
+	// transport carries the requests, replaced by SetCACert
+	transport *swappableTransport
+	// bundleCAs are the roots the session loaded from AWS_CA_BUNDLE, nil without it.
+	// The CA certificate of the object store is added to them.
+	bundleCAs *x509.CertPool
+	insecure  bool
+}
+
+// swappableProvider provides the access keys set last, so that keys can be rotated without a new session
+type swappableProvider struct {
+	value atomic.Pointer[credentials.Value]
+}
+
+func (p *swappableProvider) Retrieve() (credentials.Value, error) {
+	return *p.value.Load(), nil
+}
+
+// IsExpired always asks the credentials cache to retrieve the keys again, retrieving them is cheap
+func (p *swappableProvider) IsExpired() bool {
+	return true
+}
+
+// swappableTransport sends requests through the transport set last, so that the CA certificate can change
+type swappableTransport struct {
+	value atomic.Pointer[http.Transport]
+}
+
+func (t *swappableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.value.Load().RoundTrip(req)
 }
 
 func NewS3Agent(accessKey, secretKey, endpoint, caCert string, insecure, debug bool) (*S3Agent, error) {
@@ -60,19 +107,27 @@ func NewS3Agent(accessKey, secretKey, endpoint, caCert string, insecure, debug b
 		logLevel = aws.LogDebug
 	}
 
-	transport, err := transport.BuildTransportTLS(tlsConfig)
+	tlsTransport, err := transport.BuildTransportTLS(tlsConfig)
 	if err != nil {
 		return nil, err
 	}
+	configuredCAs := tlsTransport.TLSClientConfig.RootCAs
 	client := &http.Client{
 		Timeout:   time.Second * 15,
-		Transport: transport,
+		Transport: tlsTransport,
 	}
 
+	keys := &swappableProvider{}
+	keys.value.Store(&credentials.Value{
+		AccessKeyID:     accessKey,
+		SecretAccessKey: secretKey,
+		ProviderName:    credentials.StaticProviderName,
+	})
+
 	sess, err := session.NewSession(
 		aws.NewConfig().
 			WithRegion(nutanixRegion).
-			WithCredentials(credentials.NewStaticCredentials(accessKey, secretKey, "")).
+			WithCredentials(credentials.NewCredentials(keys)).
 			WithEndpoint(endpoint).
 			WithS3ForcePathStyle(true).
 			WithMaxRetries(5).
@@ -83,34 +138,128 @@ func NewS3Agent(accessKey, secretKey, endpoint, caCert string, insecure, debug b
 	if err != nil {
 		return nil, err
 	}
+	// the session loads the AWS_CA_BUNDLE of the environment into the transport, which must be an
+	// *http.Transport then, so the transport is only made swappable once the session is created
+	sessionTransport := client.Transport.(*http.Transport)
+	var bundleCAs *x509.CertPool
+	if !insecure && sessionTransport.TLSClientConfig.RootCAs != configuredCAs {
+		// the bundle replaced the roots of the configured CA certificate, which is added back
+		bundleCAs = sessionTransport.TLSClientConfig.RootCAs.Clone()
+		if caCert != "" {
+			if sessionTransport.TLSClientConfig.RootCAs, err = addCACert(bundleCAs, caCert); err != nil {
+				return nil, err
+			}
+		}
+	}
+	swappable := &swappableTransport{}
+	swappable.value.Store(sessionTransport)
+	client.Transport = swappable
+
 	svc := s3.New(sess)
-	return &S3Agent{
-		Client: svc,
-	}, nil
+	agent := &S3Agent{
+		Client:    svc,
+		keys:      keys,
+		transport: swappable,
+		bundleCAs: bundleCAs,
+		insecure:  insecure,
+	}
+	// requests are sent to the current endpoint, buckets are addressed in the path so only the host changes
+	svc.Handlers.Build.PushBack(func(r *request.Request) {
+		if u := agent.endpoint.Load(); u != nil {
+			r.HTTPRequest.URL.Scheme = u.Scheme
+			r.HTTPRequest.URL.Host = u.Host
+		}
+	})
+	return agent, nil
 }
 
-// CreateBucket creates a bucket with the given name
-func (s *S3Agent) CreateBucket(name string) error {
-	return s.createBucket(name)
+// SetCredentials signs the subsequent requests with the given access keys
+func (s *S3Agent) SetCredentials(accessKey, secretKey string) {
+	s.keys.value.Store(&credentials.Value{
+		AccessKeyID:     accessKey,
+		SecretAccessKey: secretKey,
+		ProviderName:    credentials.StaticProviderName,
+	})
 }
 
-func (s *S3Agent) createBucket(name string) error {
+// SetEndpoint sends the subsequent requests to endpoint, for object stores whose endpoint changes
+func (s *S3Agent) SetEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid endpoint %q: must be an http or https URL", endpoint)
+	}
+	s.endpoint.Store(u)
+	return nil
+}
 
-	klog.InfoS("Creating bucket", "name", name)
+// SetCACert verifies the subsequent connections with the given CA certificate, PEM or base64 PEM,
+// for object stores whose certificate changes. The roots of AWS_CA_BUNDLE are kept along with it.
+// An empty caCert keeps the current transport, and the call has no effect on an insecure agent.
+func (s *S3Agent) SetCACert(caCert string) error {
+	if s.insecure || caCert == "" {
+		return nil
+	}
+	rootCAs, err := addCACert(s.bundleCAs, caCert)
+	if err != nil {
+		return err
+	}
+	tlsTransport := s.transport.value.Load().Clone()
+	tlsTransport.TLSClientConfig.RootCAs = rootCAs
+	if old := s.transport.value.Swap(tlsTransport); old != nil {
+		old.CloseIdleConnections()
+	}
+	return nil
+}
+
+// addCACert returns a pool of the roots of base, which may be nil, and of the CA certificate, PEM or base64 PEM
+func addCACert(base *x509.CertPool, caCert string) (*x509.CertPool, error) {
+	pem, err := transport.DecodeCACert(caCert)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if base != nil {
+		pool = base.Clone()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("failed to append CA cert: %s", caCert)
+	}
+	return pool, nil
+}
+
+// CreateBucket creates a bucket with the given name in region, or in the default region when empty.
+// Object lock and the region can only be set when the bucket is created.
+func (s *S3Agent) CreateBucket(name string, objectLock bool, region string) error {
+	return s.createBucket(name, objectLock, region)
+}
+
+func (s *S3Agent) createBucket(name string, objectLock bool, region string) error {
+
+	klog.InfoS("Creating bucket", "name", name, "objectLock", objectLock, "region", region)
 	bucketInput := &s3.CreateBucketInput{
 		Bucket: &name,
 	}
+	if objectLock {
+		bucketInput.ObjectLockEnabledForBucket = aws.Bool(true)
+	}
+	if region != "" {
+		bucketInput.CreateBucketConfiguration = &s3.CreateBucketConfiguration{
+			LocationConstraint: aws.String(region),
+		}
+	}
 	_, err := s.Client.CreateBucket(bucketInput)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
-			klog.InfoS("DEBUG: after s3 call", "ok", ok, "aerr", aerr)
 			switch aerr.Code() {
 			case s3.ErrCodeBucketAlreadyExists:
 				klog.InfoS("Bucket already exists", "name", name)
-				return nil
+				return ErrBucketAlreadyExists
 			case s3.ErrCodeBucketAlreadyOwnedByYou:
 				klog.InfoS("Bucket already owned by you", "name", name)
-				return nil
+				return ErrBucketAlreadyOwnedByYou
 			}
 		}
 		return fmt.Errorf("failed to create bucket %q error %w", name, err)
@@ -120,6 +269,33 @@ func (s *S3Agent) createBucket(name string) error {
 	return nil
 }
 
+// GetBucketLocation returns the region the bucket was created in, empty for the default region
+func (s *S3Agent) GetBucketLocation(name string) (string, error) {
+	result, err := s.Client.GetBucketLocation(&s3.GetBucketLocationInput{
+		Bucket: aws.String(name),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(result.LocationConstraint), nil
+}
+
+// BucketExists checks that the given bucket exists and is reachable with the agent's credentials
+func (s *S3Agent) BucketExists(name string) (bool, error) {
+	_, err := s.Client.HeadBucket(&s3.HeadBucketInput{
+		Bucket: aws.String(name),
+	})
+	if err != nil {
+		// HeadBucket has no response body, so a missing bucket only surfaces as a 404
+		if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() == http.StatusNotFound {
+			return false, nil
+		}
+		klog.ErrorS(err, "failed to check bucket", "name", name)
+		return false, err
+	}
+	return true, nil
+}
+
 // DeleteBucket function deletes given bucket using s3 client
 func (s *S3Agent) DeleteBucket(name string) (bool, error) {
 	_, err := s.Client.DeleteBucket(&s3.DeleteBucketInput{
@@ -133,6 +309,124 @@ func (s *S3Agent) DeleteBucket(name string) (bool, error) {
 	return true, nil
 }
 
+// PutBucketVersioning sets the versioning state ("Enabled" or "Suspended") of the given bucket
+func (s *S3Agent) PutBucketVersioning(name, state string) error {
+	_, err := s.Client.PutBucketVersioning(&s3.PutBucketVersioningInput{
+		Bucket: aws.String(name),
+		VersioningConfiguration: &s3.VersioningConfiguration{
+			Status: aws.String(state),
+		},
+	})
+	if err != nil {
+		klog.ErrorS(err, "failed to set bucket versioning", "name", name, "state", state)
+		return err
+	}
+	return nil
+}
+
+// GetBucketVersioning returns the versioning state of the given bucket.
+// An empty string is returned if versioning was never configured on the bucket.
+func (s *S3Agent) GetBucketVersioning(name string) (string, error) {
+	out, err := s.Client.GetBucketVersioning(&s3.GetBucketVersioningInput{
+		Bucket: aws.String(name),
+	})
+	if err != nil {
+		klog.ErrorS(err, "failed to get bucket versioning", "name", name)
+		return "", err
+	}
+	return aws.StringValue(out.Status), nil
+}
+
+// PutObjectLockConfiguration applies a default retention rule to a bucket created with object lock.
+// mode is either "GOVERNANCE" or "COMPLIANCE", days is the default retention period.
+func (s *S3Agent) PutObjectLockConfiguration(name, mode string, days int64) error {
+	_, err := s.Client.PutObjectLockConfiguration(&s3.PutObjectLockConfigurationInput{
+		Bucket: aws.String(name),
+		ObjectLockConfiguration: &s3.ObjectLockConfiguration{
+			ObjectLockEnabled: aws.String(s3.ObjectLockEnabledEnabled),
+			Rule: &s3.ObjectLockRule{
+				DefaultRetention: &s3.DefaultRetention{
+					Mode: aws.String(mode),
+					Days: aws.Int64(days),
+				},
+			},
+		},
+	})
+	if err != nil {
+		klog.ErrorS(err, "failed to set object lock configuration", "name", name, "mode", mode, "days", days)
+		return err
+	}
+	return nil
+}
+
+// PutBucketTagging replaces the tag set of the given bucket
+func (s *S3Agent) PutBucketTagging(name string, tags map[string]string) error {
+	tagSet := make([]*s3.Tag, 0, len(tags))
+	for k, v := range tags {
+		tagSet = append(tagSet, &s3.Tag{
+			Key:   aws.String(k),
+			Value: aws.String(v),
+		})
+	}
+	_, err := s.Client.PutBucketTagging(&s3.PutBucketTaggingInput{
+		Bucket: aws.String(name),
+		Tagging: &s3.Tagging{
+			TagSet: tagSet,
+		},
+	})
+	if err != nil {
+		klog.ErrorS(err, "failed to set bucket tags", "name", name)
+		return err
+	}
+	return nil
+}
+
+// DeleteBucketTagging removes all tags of the given bucket
+func (s *S3Agent) DeleteBucketTagging(name string) error {
+	_, err := s.Client.DeleteBucketTagging(&s3.DeleteBucketTaggingInput{
+		Bucket: aws.String(name),
+	})
+	if err != nil {
+		klog.ErrorS(err, "failed to delete bucket tags", "name", name)
+		return err
+	}
+	return nil
+}
+
+// ListBuckets returns the names of all buckets owned by the agent's account
+func (s *S3Agent) ListBuckets() ([]string, error) {
+	out, err := s.Client.ListBuckets(&s3.ListBucketsInput{})
+	if err != nil {
+		klog.ErrorS(err, "failed to list buckets")
+		return nil, err
+	}
+	names := make([]string, 0, len(out.Buckets))
+	for _, b := range out.Buckets {
+		names = append(names, aws.StringValue(b.Name))
+	}
+	return names, nil
+}
+
+// GetBucketTagging returns the tags of the given bucket.
+// A bucket without tags returns an empty map and no error.
+func (s *S3Agent) GetBucketTagging(name string) (map[string]string, error) {
+	tags := make(map[string]string)
+	out, err := s.Client.GetBucketTagging(&s3.GetBucketTaggingInput{
+		Bucket: aws.String(name),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ErrNoSuchTagSet {
+			return tags, nil
+		}
+		klog.ErrorS(err, "failed to get bucket tags", "name", name)
+		return nil, err
+	}
+	for _, tag := range out.TagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return tags, nil
+}
+
 // PutObjectInBucket function puts an object in a bucket using s3 client
 func (s *S3Agent) PutObjectInBucket(bucketname string, body string, key string,
 	contentType string) (bool, error) {
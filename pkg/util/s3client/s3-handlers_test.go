@@ -0,0 +1,163 @@
+/*
+Copyright 2022 Nutanix Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+You may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// serverCA returns the PEM encoded certificate of a TLS test server
+func serverCA(server *httptest.Server) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+}
+
+// otherCA returns a PEM encoded self-signed certificate that did not sign the test servers
+func otherCA(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "other CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestNewS3AgentWithEnvironmentCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	writeCABundle(t, serverCA(server))
+
+	agent, err := NewS3Agent("access", "secret", server.URL, serverCA(server), false, false)
+	if err != nil {
+		t.Fatalf("NewS3Agent() error = %v", err)
+	}
+	// the CA certificate can still be replaced once the session loaded the environment bundle
+	if err := agent.SetCACert(serverCA(server)); err != nil {
+		t.Fatalf("SetCACert() error = %v", err)
+	}
+}
+
+func TestSetCACert(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	agent, err := NewS3Agent("access", "secret", server.URL, otherCA(t), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the bucket is only reported missing once the TLS handshake succeeded
+	if _, err := agent.BucketExists("bucket"); err == nil {
+		t.Fatal("BucketExists() succeeded with the CA certificate of another server")
+	}
+	if err := agent.SetCACert(serverCA(server)); err != nil {
+		t.Fatalf("SetCACert() error = %v", err)
+	}
+	if exists, err := agent.BucketExists("bucket"); err != nil || exists {
+		t.Errorf("BucketExists() = %v, %v, want false, nil", exists, err)
+	}
+}
+
+// writeCABundle points AWS_CA_BUNDLE to a file holding caCert
+func writeCABundle(t *testing.T, caCert string) {
+	t.Helper()
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(bundle, []byte(caCert), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_CA_BUNDLE", bundle)
+}
+
+func TestNewS3AgentKeepsCACertWithEnvironmentCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	writeCABundle(t, otherCA(t))
+
+	// the server is only trusted through the configured CA certificate, not the environment bundle
+	agent, err := NewS3Agent("access", "secret", server.URL, serverCA(server), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := agent.BucketExists("bucket"); err != nil || exists {
+		t.Errorf("BucketExists() = %v, %v, want false, nil", exists, err)
+	}
+}
+
+func TestSetCACertKeepsEnvironmentCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	writeCABundle(t, serverCA(server))
+
+	agent, err := NewS3Agent("access", "secret", server.URL, "", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server is still trusted through the environment bundle once another CA certificate is set
+	if err := agent.SetCACert(otherCA(t)); err != nil {
+		t.Fatalf("SetCACert() error = %v", err)
+	}
+	if exists, err := agent.BucketExists("bucket"); err != nil || exists {
+		t.Errorf("BucketExists() = %v, %v, want false, nil", exists, err)
+	}
+}
+
+func TestSetCACertEmpty(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	agent, err := NewS3Agent("access", "secret", server.URL, serverCA(server), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := agent.transport.value.Load()
+	if err := agent.SetCACert(""); err != nil {
+		t.Fatalf("SetCACert() error = %v", err)
+	}
+	if agent.transport.value.Load() != current {
+		t.Error("SetCACert() with an empty certificate replaced the transport")
+	}
+	if exists, err := agent.BucketExists("bucket"); err != nil || exists {
+		t.Errorf("BucketExists() = %v, %v, want false, nil", exists, err)
+	}
+}
@@ -44,17 +44,9 @@ func BuildTransportTLS(tlsConfig TlsConfig) (*http.Transport, error) {
 		return transport, nil
 	}
 
-	var rootCAs []byte
-	if strings.Contains(tlsConfig.CACert, "-----BEGIN CERTIFICATE-----") && strings.Contains(tlsConfig.CACert, "-----END CERTIFICATE-----") {
-		rootCAs = []byte(tlsConfig.CACert)
-	} else {
-		// Decode base64 CA cert
-		_rootCAs, err := base64.StdEncoding.DecodeString(tlsConfig.CACert)
-		if err != nil {
-			return nil, fmt.Errorf("failed to decode CA cert: %v", err)
-		}
-
-		rootCAs = _rootCAs
+	rootCAs, err := DecodeCACert(tlsConfig.CACert)
+	if err != nil {
+		return nil, err
 	}
 
 	// Create cert pool and add our CA
@@ -74,3 +66,18 @@ func BuildTransportTLS(tlsConfig TlsConfig) (*http.Transport, error) {
 
 	return transport, nil
 }
+
+// DecodeCACert returns the PEM encoded CA certificates of caCert,
+// which holds them either as PEM or as base64 encoded PEM
+func DecodeCACert(caCert string) ([]byte, error) {
+	if strings.Contains(caCert, "-----BEGIN CERTIFICATE-----") && strings.Contains(caCert, "-----END CERTIFICATE-----") {
+		return []byte(caCert), nil
+	}
+
+	// Decode base64 CA cert
+	rootCAs, err := base64.StdEncoding.DecodeString(caCert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode CA cert: %v", err)
+	}
+	return rootCAs, nil
+}